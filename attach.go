@@ -0,0 +1,176 @@
+package pmail
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/KarpelesLab/rndpass"
+)
+
+// Attach adds a file attachment to the email. If contentType is empty, it will be guessed
+// from the file name extension or the data itself. r is read immediately and kept in memory.
+func (m *Mail) Attach(name, contentType string, r io.Reader) (*Part, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if contentType == "" {
+		contentType = detectType(name, data)
+	}
+
+	p := newAttachment(name, contentType, "attachment")
+	p.Data = io.NopCloser(bytes.NewReader(data))
+	p.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(data)), nil }
+	m.mixedPart().Append(p)
+	return p, nil
+}
+
+// AttachFile adds the file found at the given path as attachment. The file is read each
+// time the email is written.
+func (m *Mail) AttachFile(fn string) (*Part, error) {
+	return m.attachOpener(filepath.Base(fn), func() (io.ReadCloser, error) { return os.Open(fn) })
+}
+
+// AttachFS adds the file found at the given path in fsys as attachment. The file is read
+// each time the email is written.
+func (m *Mail) AttachFS(fsys fs.FS, fn string) (*Part, error) {
+	return m.attachOpener(path.Base(fn), func() (io.ReadCloser, error) { return fsys.Open(fn) })
+}
+
+func (m *Mail) attachOpener(name string, open func() (io.ReadCloser, error)) (*Part, error) {
+	// open the file once to check it exists & detect its type
+	f, err := open()
+	if err != nil {
+		return nil, err
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	f.Close()
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+
+	p := newAttachment(name, detectType(name, head[:n]), "attachment")
+	p.GetBody = open
+	m.mixedPart().Append(p)
+	return p, nil
+}
+
+// mixedPart returns the multipart/mixed part of the email, creating it if needed
+func (m *Mail) mixedPart() *Part {
+	if p := m.Body.FindType(Mixed, true); p != nil {
+		return p
+	}
+	// move existing content into a new mixed part
+	mixed := NewPart(Mixed)
+	mixed.Children = m.Body.Children
+	m.Body.Children = []*Part{mixed}
+	return mixed
+}
+
+// newAttachment returns a new part with the given type and disposition. The content is
+// always base64 encoded so it is transmitted unaltered.
+func newAttachment(name, contentType, disposition string) *Part {
+	typ, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		typ, params = "application/octet-stream", make(map[string]string)
+	}
+
+	p := &Part{
+		Type:     typ,
+		Headers:  make(Header),
+		Encoding: 'b',
+	}
+	if name != "" {
+		// name is not standard but still used by some clients
+		params["name"] = name
+		p.Headers.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": name}))
+	} else {
+		p.Headers.Set("Content-Disposition", disposition)
+	}
+	p.Headers.Set("Content-Type", mime.FormatMediaType(typ, params))
+	p.Headers.Set("Content-Transfer-Encoding", "base64")
+	return p
+}
+
+// detectType guesses a content type based on the file name, and the data if that fails
+func detectType(name string, data []byte) string {
+	if typ := mime.TypeByExtension(path.Ext(name)); typ != "" {
+		return typ
+	}
+	return http.DetectContentType(data)
+}
+
+// Filename returns the file name of this part as found in the Content-Disposition header,
+// or the Content-Type name parameter.
+func (p *Part) Filename() string {
+	if _, params, err := mime.ParseMediaType(p.Headers.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	if _, params, err := mime.ParseMediaType(p.Headers.Get("Content-Type")); err == nil {
+		return params["name"]
+	}
+	return ""
+}
+
+// IsAttachment returns true if this part has an attachment disposition
+func (p *Part) IsAttachment() bool {
+	disp, _, _ := mime.ParseMediaType(p.Headers.Get("Content-Disposition"))
+	return disp == "attachment"
+}
+
+// EmbedImage adds an inline image to the email, to be referenced from the html body using
+// the returned cid: URL. If cid is empty, a random one is generated. The email structure is
+// changed to mixed(alternative(text, related(html, images...))) if needed.
+func (m *Mail) EmbedImage(cid, name string, r io.Reader) (string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	alt := m.Body.FindType(Alternative, true)
+	if alt == nil {
+		return "", errors.New("cannot embed image without an alternative content email")
+	}
+
+	rel := alt.FindType(Related, false)
+	if rel == nil {
+		rel = NewPart(Related)
+		rel.Headers.Set("Content-Type", mime.FormatMediaType(Related, map[string]string{"boundary": rel.Boundary, "type": TypeHTML}))
+
+		// move the html part (if any) into the related part
+		for n, c := range alt.Children {
+			if c.Type == TypeHTML {
+				rel.Append(c)
+				alt.Children = append(alt.Children[:n], alt.Children[n+1:]...)
+				break
+			}
+		}
+		alt.Append(rel)
+	}
+
+	if cid == "" {
+		cid = rndpass.Code(24, rndpass.RangeFull) + "@" + m.host()
+	}
+
+	p := newAttachment(name, detectType(name, data), "inline")
+	p.Headers.Set("Content-Id", "<"+cid+">")
+	p.Data = io.NopCloser(bytes.NewReader(data))
+	p.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(data)), nil }
+	rel.Append(p)
+
+	return "cid:" + cid, nil
+}
+
+// ContentId returns the Content-ID of this part, without angle brackets
+func (p *Part) ContentId() string {
+	return strings.Trim(strings.TrimSpace(p.Headers.Get("Content-Id")), "<>")
+}
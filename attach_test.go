@@ -0,0 +1,124 @@
+package pmail_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/KarpelesLab/pmail"
+)
+
+func TestAttach(t *testing.T) {
+	fsys := fstest.MapFS{
+		"docs/report.pdf": &fstest.MapFile{Data: []byte("%PDF-1.4 fake pdf")},
+	}
+
+	m := pmail.New()
+	m.SetFrom("test@example.com", "Test")
+	m.AddTo("bob@example.com", "Bob Test")
+	m.SetSubject("Attachments")
+	m.SetBodyText("See attached")
+
+	if _, err := m.Attach("résumé.txt", "", strings.NewReader("Hello\nWorld")); err != nil {
+		t.Fatalf("failed to attach: %s", err)
+	}
+	if _, err := m.AttachFS(fsys, "docs/report.pdf"); err != nil {
+		t.Fatalf("failed to attach from fs: %s", err)
+	}
+	if _, err := m.AttachFS(fsys, "docs/missing.pdf"); err == nil {
+		t.Errorf("attaching a missing file should fail")
+	}
+
+	// writing twice must produce the same output
+	buf := &bytes.Buffer{}
+	if _, err := m.WriteTo(buf); err != nil {
+		t.Fatalf("failed to write mail: %s", err)
+	}
+	buf2 := &bytes.Buffer{}
+	if _, err := m.WriteTo(buf2); err != nil {
+		t.Fatalf("failed to write mail: %s", err)
+	}
+	if !bytes.Equal(buf.Bytes(), buf2.Bytes()) {
+		t.Errorf("mail output is not replayable")
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("Content-Disposition: attachment; filename*=utf-8''r%C3%A9sum%C3%A9.txt\r\n")) {
+		t.Errorf("encoded filename not found in output:\n%s", buf.Bytes())
+	}
+
+	m2, err := pmail.Parse(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to parse mail: %s", err)
+	}
+	expect := map[string]string{
+		"résumé.txt": "Hello\nWorld",
+		"report.pdf": "%PDF-1.4 fake pdf",
+	}
+	mixed := m2.Body.FindType(pmail.Mixed, true)
+	if mixed == nil {
+		t.Fatalf("mixed part not found")
+	}
+	found := 0
+	for _, p := range mixed.Children {
+		if !p.IsAttachment() {
+			continue
+		}
+		found++
+		r, _ := p.GetBody()
+		data, _ := io.ReadAll(r)
+		if string(data) != expect[p.Filename()] {
+			t.Errorf("unexpected content for attachment %q (%s): %q", p.Filename(), p.Type, data)
+		}
+	}
+	if found != len(expect) {
+		t.Errorf("expected %d attachments, found %d", len(expect), found)
+	}
+	if p := m2.Body.FindType("application/pdf", true); p == nil {
+		t.Errorf("pdf type was not detected")
+	}
+}
+
+func TestEmbedImage(t *testing.T) {
+	m := pmail.New()
+	m.SetFrom("test@example.com", "Test")
+	m.AddTo("bob@example.com", "Bob Test")
+	m.SetSubject("Inline image")
+	m.SetBodyText("Hello")
+
+	url, err := m.EmbedImage("logo@example.com", "logo.png", bytes.NewReader([]byte("\x89PNG\r\n\x1a\nfake")))
+	if err != nil {
+		t.Fatalf("failed to embed image: %s", err)
+	}
+	if url != "cid:logo@example.com" {
+		t.Errorf("unexpected url %s", url)
+	}
+	m.SetBodyHtml(`<p>Hello</p><img src="` + url + `">`)
+
+	buf := &bytes.Buffer{}
+	if _, err := m.WriteTo(buf); err != nil {
+		t.Fatalf("failed to write mail: %s", err)
+	}
+
+	m2, err := pmail.Parse(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to parse mail: %s", err)
+	}
+	alt := m2.Body.FindType(pmail.Alternative, true)
+	if alt == nil || len(alt.Children) != 2 {
+		t.Fatalf("unexpected alternative part: %+v", alt)
+	}
+	if alt.Children[0].Type != pmail.TypeText || alt.Children[1].Type != pmail.Related {
+		t.Errorf("unexpected alternative layout: %s, %s", alt.Children[0].Type, alt.Children[1].Type)
+	}
+	rel := alt.Children[1]
+	if len(rel.Children) != 2 || rel.Children[0].Type != pmail.TypeHTML || rel.Children[1].Type != "image/png" {
+		t.Fatalf("unexpected related layout")
+	}
+	if cid := rel.Children[1].ContentId(); cid != "logo@example.com" {
+		t.Errorf("unexpected content id %q", cid)
+	}
+	if !strings.Contains(rel.Headers.Get("Content-Type"), `type="text/html"`) {
+		t.Errorf("missing type parameter in %q", rel.Headers.Get("Content-Type"))
+	}
+}
@@ -0,0 +1,240 @@
+package pmail
+
+import (
+	"errors"
+	"fmt"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errAuthUnencrypted = errors.New("unencrypted connection")
+
+// LoginAuth returns an smtp.Auth implementing the LOGIN mechanism. Like smtp.PlainAuth, it
+// will only send the credentials if the connection is using TLS or is connected to localhost.
+func LoginAuth(username, password, host string) smtp.Auth {
+	return &loginAuth{username: username, password: password, host: host}
+}
+
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := checkAuthServer(server, a.host); err != nil {
+		return "", nil, err
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	prompt := strings.ToLower(string(fromServer))
+	switch {
+	case strings.HasPrefix(prompt, "user"):
+		return []byte(a.username), nil
+	case strings.HasPrefix(prompt, "pass"):
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge: %q", fromServer)
+}
+
+// CRAMMD5Auth returns an smtp.Auth implementing the CRAM-MD5 mechanism. The password is never
+// sent to the server, which makes it usable on unencrypted connections.
+func CRAMMD5Auth(username, secret string) smtp.Auth {
+	return smtp.CRAMMD5Auth(username, secret)
+}
+
+// TokenSource provides OAuth2 access tokens. Implementations are expected to return a
+// valid token, refreshing it if needed.
+type TokenSource interface {
+	Token() (string, error)
+}
+
+// StaticToken is a TokenSource always returning the same token
+type StaticToken string
+
+func (s StaticToken) Token() (string, error) {
+	return string(s), nil
+}
+
+// RefreshingTokenSource is a TokenSource caching a token until shortly before its expiry,
+// and calling Fetch to get a new one when needed. It is safe for concurrent use.
+type RefreshingTokenSource struct {
+	Fetch func() (token string, expiry time.Time, err error)
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func (s *RefreshingTokenSource) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// refresh tokens a minute before they expire to account for clock skew
+	if s.token == "" || (!s.expiry.IsZero() && time.Now().Add(time.Minute).After(s.expiry)) {
+		token, expiry, err := s.Fetch()
+		if err != nil {
+			return "", err
+		}
+		s.token, s.expiry = token, expiry
+	}
+	return s.token, nil
+}
+
+// Invalidate forgets the cached token so a new one will be fetched on next use
+func (s *RefreshingTokenSource) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = ""
+}
+
+// XOAuth2Auth returns an smtp.Auth implementing the XOAUTH2 mechanism used by Gmail and
+// Office 365.
+func XOAuth2Auth(username string, src TokenSource, host string) smtp.Auth {
+	return &oauthAuth{mech: "XOAUTH2", username: username, src: src, host: host}
+}
+
+// OAuthBearerAuth returns an smtp.Auth implementing the OAUTHBEARER mechanism (RFC 7628)
+func OAuthBearerAuth(username string, src TokenSource, host string) smtp.Auth {
+	return &oauthAuth{mech: "OAUTHBEARER", username: username, src: src, host: host}
+}
+
+type oauthAuth struct {
+	mech     string
+	username string
+	src      TokenSource
+	host     string
+}
+
+func (a *oauthAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := checkAuthServer(server, a.host); err != nil {
+		return "", nil, err
+	}
+	token, err := a.src.Token()
+	if err != nil {
+		return "", nil, err
+	}
+
+	if a.mech == "XOAUTH2" {
+		return a.mech, []byte("user=" + a.username + "\x01auth=Bearer " + token + "\x01\x01"), nil
+	}
+	return a.mech, []byte("n,a=" + saslName(a.username) + ",\x01host=" + a.host + "\x01auth=Bearer " + token + "\x01\x01"), nil
+}
+
+// saslName escapes the authorization identity of a GS2 header (RFC 5801 4)
+func saslName(s string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(s)
+}
+
+func (a *oauthAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	// the server sent an error as a challenge, acknowledge it to get the final error reply
+	if inv, ok := a.src.(interface{ Invalidate() }); ok {
+		inv.Invalidate()
+	}
+	if a.mech == "XOAUTH2" {
+		return []byte{}, nil
+	}
+	return []byte{1}, nil
+}
+
+// PasswordAuth returns an smtp.Auth selecting the best mechanism advertised by the server among
+// PLAIN, LOGIN and CRAM-MD5. Only CRAM-MD5 is used on unencrypted connections to hosts other
+// than localhost, as other mechanisms would expose the password.
+func PasswordAuth(username, password, host string) smtp.Auth {
+	return &autoAuth{mechs: []namedAuth{
+		{"PLAIN", smtp.PlainAuth("", username, password, host)},
+		{"LOGIN", LoginAuth(username, password, host)},
+		{"CRAM-MD5", CRAMMD5Auth(username, password)},
+	}}
+}
+
+// OAuth2Auth returns an smtp.Auth using OAUTHBEARER or XOAUTH2, depending on what the server
+// advertises.
+func OAuth2Auth(username string, src TokenSource, host string) smtp.Auth {
+	return &autoAuth{mechs: []namedAuth{
+		{"OAUTHBEARER", OAuthBearerAuth(username, src, host)},
+		{"XOAUTH2", XOAuth2Auth(username, src, host)},
+	}}
+}
+
+type namedAuth struct {
+	mech string
+	auth smtp.Auth
+}
+
+// authSelector is implemented by auths choosing a mechanism based on what the server advertises.
+// selectAuth starts the chosen mechanism and returns it along with the values returned by Start.
+type authSelector interface {
+	selectAuth(server *smtp.ServerInfo) (smtp.Auth, string, []byte, error)
+}
+
+// autoAuth selects the first mechanism supported by the server that accepts to start. Within
+// pmail the selection happens for each session through selectAuth, so the same autoAuth can
+// be used by concurrent sessions. Start and Next are only used by other clients such as
+// net/smtp, and cannot be used concurrently.
+type autoAuth struct {
+	mechs []namedAuth
+	cur   smtp.Auth
+}
+
+func (a *autoAuth) selectAuth(server *smtp.ServerInfo) (smtp.Auth, string, []byte, error) {
+	var lastErr error
+	for _, m := range a.mechs {
+		if !hasMech(server.Auth, m.mech) {
+			continue
+		}
+		mech, resp, err := m.auth.Start(server)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return m.auth, mech, resp, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no supported auth mechanism among %s", strings.Join(server.Auth, " "))
+	}
+	return nil, "", nil, lastErr
+}
+
+func (a *autoAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	cur, mech, resp, err := a.selectAuth(server)
+	a.cur = cur
+	return mech, resp, err
+}
+
+func (a *autoAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	return a.cur.Next(fromServer, more)
+}
+
+func hasMech(list []string, mech string) bool {
+	for _, m := range list {
+		if strings.EqualFold(m, mech) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAuthServer ensures credentials are only sent over TLS or to localhost, and to the
+// expected host, as done by smtp.PlainAuth
+func checkAuthServer(server *smtp.ServerInfo, host string) error {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return errAuthUnencrypted
+	}
+	if server.Name != host {
+		return errors.New("wrong host name")
+	}
+	return nil
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
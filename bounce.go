@@ -0,0 +1,352 @@
+package pmail
+
+import (
+	"bufio"
+	"bytes"
+	"html"
+	"io"
+	"mime"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+// BounceType classifies the outcome of a delivery reported in a bounce
+type BounceType int
+
+const (
+	BounceNone BounceType = iota // not a failure: delivered, relayed or expanded
+	BounceSoft                   // temporary failure or issue unrelated to the address, such as a full mailbox
+	BounceHard                   // permanent failure, the address should not be used anymore
+)
+
+func (b BounceType) String() string {
+	switch b {
+	case BounceSoft:
+		return "soft"
+	case BounceHard:
+		return "hard"
+	default:
+		return "none"
+	}
+}
+
+// DSNReport is the content of a delivery status notification or bounce message
+type DSNReport struct {
+	Standard     bool   // true if read from a RFC 3464 report, false if guessed from the text of the bounce
+	MessageId    string // Message-Id of the original message, if found
+	EnvID        string // envelope identifier given when sending (see DSNRequest)
+	ReportingMTA string // server that generated the report
+	Recipients   []*DSNRecipient
+}
+
+// DSNRecipient is the delivery status for a recipient of the original message
+type DSNRecipient struct {
+	Recipient         string // final recipient address
+	OriginalRecipient string // original recipient (ORCPT), if provided
+	Action            string // failed, delayed, delivered, relayed or expanded
+	Status            string // RFC 3463 status code such as "5.1.1"
+	DiagnosticCode    string // reply of the remote server, such as "550 5.1.1 User unknown"
+	RemoteMTA         string // server that rejected the message, if known
+	Bounce            BounceType
+}
+
+var (
+	reEnhancedStatus = regexp.MustCompile(`\b([245]\.\d{1,3}\.\d{1,3})\b`)
+	reReplyCode      = regexp.MustCompile(`(?:^|[\s'"(])([45]\d\d)[ -]`)
+	reBounceAddress  = regexp.MustCompile(`[A-Za-z0-9._%+=-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`)
+	reMessageId      = regexp.MustCompile(`(?i)message-id:\s*<([^>\s]+)>`)
+	reHTMLTag        = regexp.MustCompile(`<[^>]*>`)
+
+	// postfix text bounces list recipients as "<addr>: reason", continued on indented lines
+	rePostfixRecipient = regexp.MustCompile(`(?m)^<([^<>\s]+@[^<>\s]+)>(?: \(expanded from <[^>]*>\))?:[ \t]*(.*(?:\r?\n[ \t]+.*)*)`)
+)
+
+// bounceSubjects are found in the subject of common non-standard bounces
+var bounceSubjects = []string{
+	"undeliverable", "undelivered", "delivery status notification", "returned mail",
+	"delivery failure", "failure notice", "delivery failed", "delivery has failed",
+	"could not be delivered", "returned to sender", "delivery incomplete",
+}
+
+// hardKeywords and softKeywords classify diagnostics without a usable status code
+var (
+	hardKeywords = []string{
+		"user unknown", "unknown user", "no such user", "does not exist", "doesn't exist",
+		"not found", "address rejected", "invalid recipient", "invalid address", "unknown recipient",
+		"no mailbox", "mailbox unavailable", "mailbox not found", "account has been disabled",
+		"couldn't be found", "recipnotfound",
+	}
+	softKeywords = []string{
+		"mailbox full", "mailbox is full", "over quota", "quota exceeded", "insufficient storage",
+		"try again", "temporarily", "temporary", "delayed", "will retry", "too many", "message too large",
+		"spam", "blocked", "rate limit",
+	}
+)
+
+// ParseDSN reads a delivery status notification (RFC 3464) or a non-standard bounce message
+// from r. ErrNotDSN is returned if the message does not look like a bounce.
+func ParseDSN(r io.Reader) (*DSNReport, error) {
+	m, err := Parse(r)
+	if err != nil {
+		return nil, err
+	}
+	return m.DSNReport()
+}
+
+// DSNReport returns the delivery status information found in this email, which should be a
+// bounce. Non-standard bounces such as the text bounces of Postfix, Exchange or Gmail are
+// recognized heuristically.
+func (m *Mail) DSNReport() (*DSNReport, error) {
+	var status, orig, text, htmlText *Part
+	var walk func(p *Part)
+	walk = func(p *Part) {
+		switch p.Type {
+		case "message/delivery-status", "message/global-delivery-status":
+			status = p
+		case TypeEmail, "message/global", "text/rfc822-headers", "message/global-headers":
+			orig = p
+		case TypeText:
+			if text == nil {
+				text = p
+			}
+		case TypeHTML:
+			if htmlText == nil {
+				htmlText = p
+			}
+		}
+		for _, c := range p.Children {
+			walk(c)
+		}
+	}
+	for _, c := range m.Body.Children {
+		walk(c)
+	}
+
+	rep := &DSNReport{}
+	if orig != nil {
+		if data, err := orig.readBody(); err == nil {
+			if h, err := readHeader(bufio.NewReader(bytes.NewReader(data))); err == nil {
+				rep.MessageId = strings.Trim(strings.TrimSpace(h.Get("Message-Id")), "<>")
+			}
+		}
+	}
+
+	if status != nil {
+		data, err := status.readBody()
+		if err != nil {
+			return nil, err
+		}
+		rep.Standard = true
+		rep.parseDeliveryStatus(data)
+		if rep.MessageId == "" {
+			rep.MessageId = m.bounceMessageId("")
+		}
+		return rep, nil
+	}
+
+	if !m.looksLikeBounce() {
+		return nil, ErrNotDSN
+	}
+
+	var body string
+	if text != nil {
+		data, _ := text.readBody()
+		body = string(data)
+	} else if htmlText != nil {
+		data, _ := htmlText.readBody()
+		body = html.UnescapeString(reHTMLTag.ReplaceAllString(string(data), " "))
+	}
+	if rep.MessageId == "" {
+		rep.MessageId = m.bounceMessageId(body)
+	}
+	rep.guessRecipients(m, body)
+	return rep, nil
+}
+
+// parseDeliveryStatus reads the fields of a message/delivery-status part: a group of
+// per-message fields followed by a group for each recipient
+func (rep *DSNReport) parseDeliveryStatus(data []byte) {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+	first := true
+	for {
+		h, err := r.ReadMIMEHeader()
+		if len(h) > 0 {
+			if first {
+				rep.ReportingMTA = typedValue(h.Get("Reporting-Mta"))
+				rep.EnvID = strings.TrimSpace(h.Get("Original-Envelope-Id"))
+				first = false
+			} else if h.Get("Final-Recipient") != "" || h.Get("Original-Recipient") != "" {
+				rep.Recipients = append(rep.Recipients, newDSNRecipient(h))
+			}
+		}
+		if err != nil {
+			// stop at the end of the data, or at the first malformed group
+			return
+		}
+	}
+}
+
+func newDSNRecipient(h textproto.MIMEHeader) *DSNRecipient {
+	rcpt := &DSNRecipient{
+		Recipient:         strings.Trim(typedValue(h.Get("Final-Recipient")), "<>"),
+		OriginalRecipient: strings.Trim(typedValue(h.Get("Original-Recipient")), "<>"),
+		Action:            strings.ToLower(strings.TrimSpace(h.Get("Action"))),
+		DiagnosticCode:    typedValue(h.Get("Diagnostic-Code")),
+		RemoteMTA:         typedValue(h.Get("Remote-Mta")),
+	}
+	if rcpt.Recipient == "" {
+		rcpt.Recipient = rcpt.OriginalRecipient
+	}
+	if f := strings.Fields(h.Get("Status")); len(f) > 0 {
+		rcpt.Status = f[0]
+	}
+	if rcpt.Status == "" {
+		rcpt.Status = findStatus(rcpt.DiagnosticCode)
+	}
+	rcpt.Bounce = classifyBounce(rcpt.Action, rcpt.Status, rcpt.DiagnosticCode, BounceHard)
+	return rcpt
+}
+
+// guessRecipients finds the failed recipients and their diagnostic in the text of a
+// non-standard bounce
+func (rep *DSNReport) guessRecipients(m *Mail, body string) {
+	action := "failed"
+	if strings.Contains(strings.ToLower(m.Body.Headers.Get("Subject")), "delay") {
+		action = "delayed"
+	}
+	add := func(addr, diag string) {
+		rcpt := &DSNRecipient{Recipient: addr, Action: action, DiagnosticCode: diag, Status: findStatus(diag)}
+		rcpt.Bounce = classifyBounce(action, rcpt.Status, diag, BounceSoft)
+		rep.Recipients = append(rep.Recipients, rcpt)
+	}
+
+	if matches := rePostfixRecipient.FindAllStringSubmatch(body, -1); len(matches) > 0 {
+		for _, match := range matches {
+			add(match[1], strings.Join(strings.Fields(match[2]), " "))
+		}
+		return
+	}
+
+	// other bounces: use all addresses found in the text, and the first line with a status
+	diag := ""
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if findStatus(line) != "" {
+			diag = line
+			break
+		}
+		if diag == "" && hasKeyword(strings.ToLower(line), hardKeywords) {
+			diag = line
+		}
+	}
+
+	// ignore the addresses of the bounce itself
+	ignore := map[string]bool{strings.ToLower(rep.MessageId): true}
+	if m.From != nil {
+		ignore[strings.ToLower(m.From.Address)] = true
+	}
+	for _, a := range m.To {
+		ignore[strings.ToLower(a.Address)] = true
+	}
+	for _, addr := range reBounceAddress.FindAllString(body, -1) {
+		k := strings.ToLower(addr)
+		local := k[:strings.IndexByte(k, '@')]
+		if ignore[k] || local == "mailer-daemon" || local == "postmaster" {
+			continue
+		}
+		ignore[k] = true
+		add(addr, diag)
+	}
+}
+
+// looksLikeBounce returns true if the sender or subject are those of a bounce
+func (m *Mail) looksLikeBounce() bool {
+	if m.From != nil {
+		from := strings.ToLower(m.From.Address)
+		if strings.HasPrefix(from, "mailer-daemon@") || strings.HasPrefix(from, "postmaster@") {
+			return true
+		}
+	}
+	return hasKeyword(strings.ToLower(m.Body.Headers.Get("Subject")), bounceSubjects)
+}
+
+// bounceMessageId returns the Message-Id of the original message, as referenced by the bounce
+// headers or found in its text
+func (m *Mail) bounceMessageId(body string) string {
+	if v := m.Body.Headers.Get("In-Reply-To"); v != "" {
+		return strings.Trim(strings.TrimSpace(v), "<>")
+	}
+	if match := reMessageId.FindStringSubmatch(body); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+// classifyBounce returns the bounce type for the given delivery status. def is used for
+// failures that cannot be classified.
+func classifyBounce(action, status, diag string, def BounceType) BounceType {
+	switch action {
+	case "delivered", "relayed", "expanded":
+		return BounceNone
+	case "delayed":
+		return BounceSoft
+	}
+
+	diag = strings.ToLower(diag)
+	switch {
+	case strings.HasPrefix(status, "4."):
+		return BounceSoft
+	case strings.HasPrefix(status, "5.1."), status == "5.2.1":
+		// bad destination address or disabled mailbox
+		return BounceHard
+	case status == "5.2.2", status == "5.3.4":
+		// mailbox full, message too large
+		return BounceSoft
+	}
+	if hasKeyword(diag, hardKeywords) {
+		return BounceHard
+	}
+	if hasKeyword(diag, softKeywords) || strings.HasPrefix(status, "5.7.") {
+		// policy rejections are often caused by the content or the sender reputation
+		return BounceSoft
+	}
+	if strings.HasPrefix(status, "5.") {
+		return BounceHard
+	}
+	return def
+}
+
+// findStatus returns the RFC 3463 status code found in s, or one derived from the SMTP reply
+// code if there is none
+func findStatus(s string) string {
+	if match := reEnhancedStatus.FindStringSubmatch(s); match != nil {
+		return match[1]
+	}
+	if match := reReplyCode.FindStringSubmatch(s); match != nil {
+		return match[1][:1] + ".0.0"
+	}
+	return ""
+}
+
+// typedValue returns the value of a DSN field such as "rfc822; user@example.com" without its
+// type, decoding encoded-words if any
+func typedValue(v string) string {
+	if _, val, ok := strings.Cut(v, ";"); ok {
+		v = val
+	}
+	v = strings.TrimSpace(v)
+	if d, err := (&mime.WordDecoder{}).DecodeHeader(v); err == nil {
+		v = d
+	}
+	return v
+}
+
+func hasKeyword(s string, keywords []string) bool {
+	for _, k := range keywords {
+		if strings.Contains(s, k) {
+			return true
+		}
+	}
+	return false
+}
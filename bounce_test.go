@@ -0,0 +1,135 @@
+package pmail_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/KarpelesLab/pmail"
+)
+
+const testStandardDSN = `From: MAILER-DAEMON@mx.example.net (Mail Delivery System)
+To: billing@example.com
+Subject: Undelivered Mail Returned to Sender
+MIME-Version: 1.0
+Content-Type: multipart/report; report-type=delivery-status; boundary="XYZ"
+
+--XYZ
+Content-Type: text/plain
+
+This is the mail system at host mx.example.net.
+
+--XYZ
+Content-Type: message/delivery-status
+
+Reporting-MTA: dns; mx.example.net
+Original-Envelope-Id: invoice-42@example.com
+
+Final-Recipient: rfc822; bob@example.org
+Original-Recipient: rfc822;bob@example.org
+Action: failed
+Status: 5.1.1
+Remote-MTA: dns; mail.example.org
+Diagnostic-Code: smtp; 550 5.1.1 <bob@example.org>: Recipient address rejected:
+    User unknown in local recipient table
+
+Final-Recipient: rfc822; alice@example.org
+Action: delayed
+Status: 4.2.2
+Diagnostic-Code: smtp; 452 4.2.2 Mailbox full
+
+--XYZ
+Content-Type: text/rfc822-headers
+
+From: billing@example.com
+To: bob@example.org, alice@example.org
+Subject: Invoice
+Message-Id: <invoice-42@example.com>
+
+--XYZ--
+`
+
+const testGmailBounce = `From: Mail Delivery Subsystem <mailer-daemon@googlemail.com>
+To: billing@example.com
+Subject: Delivery Status Notification (Failure)
+In-Reply-To: <invoice-43@example.com>
+Content-Type: text/plain; charset=UTF-8
+
+Address not found
+
+Your message wasn't delivered to carol@example.org because the address couldn't be found, or is unable to receive mail.
+
+The response from the remote server was:
+550 5.1.1 The email account that you tried to reach does not exist.
+`
+
+const testPostfixBounce = `From: MAILER-DAEMON@mx.example.com (Mail Delivery System)
+To: billing@example.com
+Subject: Undelivered Mail Returned to Sender
+Content-Type: text/plain
+
+I'm sorry to have to inform you that your message could not
+be delivered to one or more recipients.
+
+<dave@example.org>: host mx.example.org[203.0.113.5] said: 552 5.2.2 Mailbox
+    full (in reply to RCPT TO command)
+
+<erin@example.org>: host mx.example.org[203.0.113.5] said: 550 No such user
+    here (in reply to RCPT TO command)
+`
+
+func TestParseDSN(t *testing.T) {
+	rep, err := pmail.ParseDSN(strings.NewReader(testStandardDSN))
+	if err != nil {
+		t.Fatalf("failed to parse DSN: %s", err)
+	}
+	if !rep.Standard || rep.MessageId != "invoice-42@example.com" || rep.EnvID != "invoice-42@example.com" || rep.ReportingMTA != "mx.example.net" {
+		t.Errorf("unexpected report: %+v", rep)
+	}
+	if len(rep.Recipients) != 2 {
+		t.Fatalf("expected 2 recipients, got %d", len(rep.Recipients))
+	}
+	r := rep.Recipients[0]
+	if r.Recipient != "bob@example.org" || r.Action != "failed" || r.Status != "5.1.1" || r.RemoteMTA != "mail.example.org" || r.Bounce != pmail.BounceHard {
+		t.Errorf("unexpected recipient: %+v", r)
+	}
+	if !strings.HasPrefix(r.DiagnosticCode, "550 5.1.1 <bob@example.org>: Recipient address rejected:") {
+		t.Errorf("unexpected diagnostic: %q", r.DiagnosticCode)
+	}
+	if r := rep.Recipients[1]; r.Recipient != "alice@example.org" || r.Action != "delayed" || r.Bounce != pmail.BounceSoft {
+		t.Errorf("unexpected recipient: %+v", r)
+	}
+}
+
+func TestParseBounceHeuristics(t *testing.T) {
+	rep, err := pmail.ParseDSN(strings.NewReader(testGmailBounce))
+	if err != nil {
+		t.Fatalf("failed to parse bounce: %s", err)
+	}
+	if rep.Standard || rep.MessageId != "invoice-43@example.com" || len(rep.Recipients) != 1 {
+		t.Fatalf("unexpected report: %+v", rep)
+	}
+	if r := rep.Recipients[0]; r.Recipient != "carol@example.org" || r.Status != "5.1.1" || r.Bounce != pmail.BounceHard {
+		t.Errorf("unexpected recipient: %+v", r)
+	}
+
+	rep, err = pmail.ParseDSN(strings.NewReader(testPostfixBounce))
+	if err != nil {
+		t.Fatalf("failed to parse bounce: %s", err)
+	}
+	if len(rep.Recipients) != 2 {
+		t.Fatalf("expected 2 recipients, got %+v", rep.Recipients)
+	}
+	if r := rep.Recipients[0]; r.Recipient != "dave@example.org" || r.Status != "5.2.2" || r.Bounce != pmail.BounceSoft {
+		t.Errorf("unexpected recipient: %+v", r)
+	}
+	if r := rep.Recipients[1]; r.Recipient != "erin@example.org" || r.Status != "5.0.0" || r.Bounce != pmail.BounceHard {
+		t.Errorf("unexpected recipient: %+v", r)
+	}
+
+	m := testMail()
+	m.SetSubject("Hello")
+	if _, err := m.DSNReport(); !errors.Is(err, pmail.ErrNotDSN) {
+		t.Errorf("expected ErrNotDSN, got %v", err)
+	}
+}
@@ -0,0 +1,279 @@
+package pmail
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resolver is used by DirectSender for DNS lookups. *net.Resolver implements it.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// DirectSender delivers emails directly to the mail servers of the recipients' domains, as
+// found in their MX records, without going through a relay.
+type DirectSender struct {
+	Resolver   Resolver    // defaults to net.DefaultResolver
+	Port       int         // defaults to 25
+	LocalName  string      // name sent in EHLO, defaults to the host name
+	TLSConfig  *tls.Config // if nil, STARTTLS is used without verifying certificates unless RequireTLS is set
+	RequireTLS bool        // fail if the connection cannot be secured with a valid certificate
+
+	// PartialDelivery allows sending the email to the accepted recipients of a domain when
+	// others are rejected, see RelaySender.
+	PartialDelivery bool
+
+	DialTimeout    time.Duration
+	CommandTimeout time.Duration
+	DataTimeout    time.Duration
+}
+
+// DomainResult is the outcome of the delivery to the recipients of a domain
+type DomainResult struct {
+	Domain string
+	Host   string      // MX host that accepted the email, if any
+	Result *SendResult // per-recipient results
+	Err    error       // error if the email could not be delivered to the domain
+}
+
+// Send delivers the email to the recipients' mail servers
+func (d *DirectSender) Send(from string, to []string, msg io.WriterTo) error {
+	return d.SendContext(context.Background(), NewEnvelope(from, to...), msg)
+}
+
+// SendContext delivers the email to the recipients' mail servers. An error is returned if
+// delivery failed for any recipient.
+func (d *DirectSender) SendContext(ctx context.Context, env *Envelope, msg io.WriterTo) error {
+	res, err := d.Deliver(ctx, env, msg)
+	if err != nil {
+		return err
+	}
+	return res.Err()
+}
+
+// Deliver delivers the email to the recipients' mail servers and returns the result for each
+// recipient. An error is returned only if no recipient accepted the email.
+func (d *DirectSender) Deliver(ctx context.Context, env *Envelope, msg io.WriterTo) (*SendResult, error) {
+	res := &SendResult{}
+	for _, dr := range d.DeliverDomains(ctx, env, msg) {
+		if dr.Result != nil {
+			res.Accepted = append(res.Accepted, dr.Result.Accepted...)
+			res.Rejected = append(res.Rejected, dr.Result.Rejected...)
+		}
+	}
+	if ctx.Err() != nil {
+		return res, ctx.Err()
+	}
+	if len(res.Accepted) == 0 {
+		return res, res.Err()
+	}
+	return res, nil
+}
+
+// DeliverDomains delivers the email to the recipients' mail servers and returns the result for
+// each domain.
+func (d *DirectSender) DeliverDomains(ctx context.Context, env *Envelope, msg io.WriterTo) []*DomainResult {
+	// group recipients by domain, keeping the original order
+	var domains []string
+	byDomain := make(map[string][]*Recipient)
+	for _, rcpt := range env.Recipients {
+		pos := strings.LastIndexByte(rcpt.Address, '@')
+		domain := ""
+		if pos != -1 {
+			domain = strings.ToLower(rcpt.Address[pos+1:])
+		}
+		if _, ok := byDomain[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		byDomain[domain] = append(byDomain[domain], rcpt)
+	}
+
+	res := make([]*DomainResult, 0, len(domains))
+
+	// messages other than Mail may only be readable once, keep a copy to send them to each
+	// domain and MX host
+	if _, ok := msg.(writer7Bit); !ok {
+		buf := &bytes.Buffer{}
+		if _, err := msg.WriteTo(buf); err != nil {
+			for _, domain := range domains {
+				sub := *env
+				sub.Recipients = byDomain[domain]
+				res = append(res, domainFailure(domain, &sub, err))
+			}
+			return res
+		}
+		msg = &replayWriter{buf.Bytes()}
+	}
+
+	for _, domain := range domains {
+		sub := *env
+		sub.Recipients = byDomain[domain]
+		res = append(res, d.deliverDomain(ctx, domain, &sub, msg))
+	}
+	return res
+}
+
+// domainFailure returns a result for domain where all recipients are rejected with err
+func domainFailure(domain string, env *Envelope, err error) *DomainResult {
+	dr := &DomainResult{Domain: domain, Err: err, Result: &SendResult{}}
+	for _, rcpt := range env.Recipients {
+		e := *smtpErr(PhaseConnect, err)
+		e.Recipient = rcpt.Address
+		dr.Result.Rejected = append(dr.Result.Rejected, &e)
+	}
+	return dr
+}
+
+func (d *DirectSender) deliverDomain(ctx context.Context, domain string, env *Envelope, msg io.WriterTo) *DomainResult {
+	dr := &DomainResult{Domain: domain}
+	fail := func(err error) *DomainResult {
+		return domainFailure(domain, env, err)
+	}
+
+	if domain == "" {
+		return fail(&SMTPError{Phase: PhaseRcpt, Code: 501, Enhanced: "5.1.3", Message: "invalid recipient address"})
+	}
+
+	hosts, err := d.lookupMX(ctx, domain)
+	if err != nil {
+		return fail(err)
+	}
+
+	var lastErr error = &SMTPError{Phase: PhaseConnect, Message: fmt.Sprintf("no reachable host for domain %s", domain)}
+	for _, host := range hosts {
+		addrs, err := d.resolver().LookupHost(ctx, host)
+		if err != nil {
+			lastErr = smtpErr(PhaseConnect, err)
+			continue
+		}
+		for _, addr := range addrs {
+			if ctx.Err() != nil {
+				return fail(ctx.Err())
+			}
+			res, err := d.deliverHost(ctx, host, addr, env, msg)
+			if err == nil {
+				dr.Host = host
+				dr.Result = res
+				return dr
+			}
+			if hasReplies(res) {
+				// the host answered for the recipients, do not try other hosts
+				dr.Err = err
+				dr.Result = res
+				return dr
+			}
+			if isPermanent(err) {
+				return fail(err)
+			}
+			lastErr = err
+		}
+	}
+	return fail(lastErr)
+}
+
+// deliverHost sends the email to a given MX host, at the given address
+func (d *DirectSender) deliverHost(ctx context.Context, host, addr string, env *Envelope, msg io.WriterTo) (*SendResult, error) {
+	port := d.Port
+	if port == 0 {
+		port = 25
+	}
+	r := &RelaySender{
+		Host:            host,
+		Port:            port,
+		TLSConfig:       d.TLSConfig,
+		LocalName:       d.localName(),
+		RequireTLS:      d.RequireTLS,
+		TLSMode:         TLSStartTLS, // MX hosts use STARTTLS on any port
+		PartialDelivery: d.PartialDelivery,
+		DialTimeout:     d.DialTimeout,
+		CommandTimeout:  d.CommandTimeout,
+		DataTimeout:     d.DataTimeout,
+	}
+	if r.TLSConfig == nil && !d.RequireTLS {
+		// opportunistic TLS (RFC 7435), MX hosts often do not have a valid certificate
+		r.TLSConfig = &tls.Config{ServerName: host, InsecureSkipVerify: true}
+	}
+
+	cl, err := r.dialAddr(ctx, net.JoinHostPort(addr, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	defer cl.close()
+	defer watchContext(ctx, cl.conn)()
+
+	res, err := sendSMTPEnvelope(cl, env, msg, d.PartialDelivery)
+	if err != nil {
+		return res, err
+	}
+	cl.quit()
+	return res, nil
+}
+
+// hasReplies returns true if the server replied to RCPT for some recipients, meaning the
+// result should be kept as is
+func hasReplies(res *SendResult) bool {
+	if res == nil {
+		return false
+	}
+	for _, e := range res.Rejected {
+		if e.Code != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupMX returns the hosts to try for the domain, in preference order
+func (d *DirectSender) lookupMX(ctx context.Context, domain string) ([]string, error) {
+	mxs, err := d.resolver().LookupMX(ctx, domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return nil, smtpErr(PhaseConnect, err)
+		}
+		mxs = nil
+	}
+	if len(mxs) == 0 {
+		// RFC 5321 5.1: no MX records, use the domain itself
+		return []string{domain}, nil
+	}
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		// RFC 7505 null MX, domain does not accept email
+		return nil, &SMTPError{Phase: PhaseConnect, Code: 556, Enhanced: "5.1.10", Message: fmt.Sprintf("domain %s does not accept email", domain)}
+	}
+
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	res := make([]string, len(mxs))
+	for n, mx := range mxs {
+		res[n] = strings.TrimSuffix(mx.Host, ".")
+	}
+	return res, nil
+}
+
+func (d *DirectSender) resolver() Resolver {
+	if d.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return d.Resolver
+}
+
+func (d *DirectSender) localName() string {
+	if d.LocalName != "" {
+		return d.LocalName
+	}
+	if h, err := os.Hostname(); err == nil {
+		return h
+	}
+	return "localhost"
+}
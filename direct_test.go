@@ -0,0 +1,147 @@
+package pmail_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/KarpelesLab/pmail"
+)
+
+// fakeResolver serves MX and address records from maps
+type fakeResolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string][]string
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if mx, ok := r.mx[name]; ok {
+		return mx, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestDirectSender(t *testing.T) {
+	srv := newFakeSMTP(t, "starttls").start()
+
+	res := &fakeResolver{
+		mx: map[string][]*net.MX{
+			"a.test": {{Host: "mx2.a.test.", Pref: 20}, {Host: "mx1.a.test.", Pref: 10}},
+			"c.test": {{Host: ".", Pref: 0}},
+		},
+		hosts: map[string][]string{
+			"mx1.a.test": {"127.0.0.2"}, // nothing listening there
+			"mx2.a.test": {"127.0.0.1"},
+			"b.test":     {"127.0.0.1"},
+		},
+	}
+	d := &pmail.DirectSender{Resolver: res, Port: srv.port(), LocalName: "client.test"}
+
+	env := pmail.NewEnvelope("test@example.com", "one@a.test", "two@A.test", "three@b.test", "four@c.test")
+	results := d.DeliverDomains(context.Background(), env, testMail())
+	if len(results) != 3 {
+		t.Fatalf("expected 3 domain results, got %d", len(results))
+	}
+	if r := results[0]; r.Domain != "a.test" || r.Host != "mx2.a.test" || r.Err != nil || len(r.Result.Accepted) != 2 {
+		t.Errorf("unexpected result for a.test: %+v", r)
+	}
+	if r := results[1]; r.Domain != "b.test" || r.Host != "b.test" || r.Err != nil {
+		t.Errorf("unexpected result for b.test: %+v", r)
+	}
+	var se *pmail.SMTPError
+	if r := results[2]; r.Domain != "c.test" || !errors.As(r.Err, &se) || !se.Permanent() {
+		t.Errorf("unexpected result for c.test: %+v", r)
+	}
+
+	cmds := strings.Join(srv.commands(), "\n")
+	if !strings.Contains(cmds, "STARTTLS") || !strings.Contains(cmds, "EHLO client.test") {
+		t.Errorf("expected STARTTLS session, got:\n%s", cmds)
+	}
+	if len(srv.msgs) != 2 {
+		t.Errorf("expected 2 messages delivered, got %d", len(srv.msgs))
+	}
+
+	sr, err := d.Deliver(context.Background(), env, testMail())
+	if err != nil {
+		t.Fatalf("expected partial success, got %s", err)
+	}
+	if len(sr.Accepted) != 3 || len(sr.Rejected) != 1 || sr.Rejected[0].Recipient != "four@c.test" {
+		t.Errorf("unexpected result: %+v", sr)
+	}
+}
+
+func TestDirectSenderRejects(t *testing.T) {
+	srv := newFakeSMTP(t, "")
+	srv.fail["RCPT TO:<bad@a.test>"] = "550 5.1.1 User unknown"
+	srv.fail["RCPT TO:<worse@a.test>"] = "550 5.1.1 User unknown"
+	srv.start()
+
+	res := &fakeResolver{
+		mx:    map[string][]*net.MX{"a.test": {{Host: "mx1.a.test.", Pref: 10}, {Host: "mx2.a.test.", Pref: 20}}},
+		hosts: map[string][]string{"mx1.a.test": {"127.0.0.1"}, "mx2.a.test": {"127.0.0.1"}},
+	}
+	d := &pmail.DirectSender{Resolver: res, Port: srv.port(), LocalName: "client.test"}
+
+	for _, rcpts := range [][]string{{"good@a.test", "bad@a.test"}, {"good@a.test", "bad@a.test", "worse@a.test"}} {
+		srv.mu.Lock()
+		srv.log = nil
+		srv.mu.Unlock()
+
+		sr, err := d.Deliver(context.Background(), pmail.NewEnvelope("test@example.com", rcpts...), testMail())
+		if err == nil || len(sr.Accepted) != 0 || len(sr.Rejected) != len(rcpts) {
+			t.Fatalf("unexpected result: %+v, %v", sr, err)
+		}
+		for _, e := range sr.Rejected {
+			if e.Recipient == "good@a.test" && (!e.Temporary() || !errors.Is(e, pmail.ErrNotSent)) {
+				t.Errorf("accepted recipient should be retried later, got %v", e)
+			} else if e.Recipient != "good@a.test" && (e.Code != 550 || !e.Permanent()) {
+				t.Errorf("unexpected rejection %v", e)
+			}
+		}
+		// the first MX replied for the recipients, the second one must not be tried
+		if n := strings.Count(strings.Join(srv.commands(), "\n"), "MAIL FROM"); n != 1 {
+			t.Errorf("expected a single transaction, got %d", n)
+		}
+	}
+	if len(srv.msgs) != 0 {
+		t.Errorf("message should not have been sent")
+	}
+}
+
+func TestDirectSenderUnreachable(t *testing.T) {
+	srv := newFakeSMTP(t, "").start()
+	res := &fakeResolver{
+		hosts: map[string][]string{
+			"a.test": {"127.0.0.1"},
+			"b.test": {"127.0.0.1"},
+			"c.test": {}, // no address and no error
+		},
+	}
+	d := &pmail.DirectSender{Resolver: res, Port: srv.port(), LocalName: "client.test"}
+
+	// a message readable only once is delivered in full to each domain
+	msg := bytes.NewReader([]byte("Subject: Hello\r\n\r\nHello\r\n"))
+	env := pmail.NewEnvelope("test@example.com", "one@a.test", "two@b.test", "three@c.test")
+	results := d.DeliverDomains(context.Background(), env, msg)
+	if len(results) != 3 || results[0].Err != nil || results[1].Err != nil {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+	if r := results[2]; r.Err == nil || len(r.Result.Rejected) != 1 || r.Result.Rejected[0].Recipient != "three@c.test" {
+		t.Errorf("unexpected result for c.test: %+v", r)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.msgs) != 2 || srv.msgs[0] != srv.msgs[1] || !strings.HasSuffix(srv.msgs[1], "Hello\r\n") {
+		t.Errorf("unexpected messages: %q", srv.msgs)
+	}
+}
@@ -0,0 +1,387 @@
+package pmail
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultDKIMHeaders is the list of headers signed by DKIMSigner when Headers is not set. Only
+// headers present in the message are signed.
+var DefaultDKIMHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-Id", "In-Reply-To", "References",
+	"Mime-Version", "Content-Type", "Content-Transfer-Encoding", "List-Id", "List-Unsubscribe",
+	"List-Unsubscribe-Post",
+}
+
+// DKIM canonicalization algorithms
+const (
+	DKIMSimple  = "simple"
+	DKIMRelaxed = "relaxed"
+)
+
+// DKIMSigner signs messages using DKIM (RFC 6376)
+type DKIMSigner struct {
+	Domain   string        // signing domain (d=)
+	Selector string        // selector of the public key in DNS (s=)
+	Key      crypto.Signer // *rsa.PrivateKey (rsa-sha256) or ed25519.PrivateKey (ed25519-sha256, RFC 8463)
+
+	Headers  []string // headers to sign, defaults to DefaultDKIMHeaders
+	Oversign []string // headers signed once more than present, so additional instances cannot be added
+
+	HeaderCanonicalization string // DKIMRelaxed (default) or DKIMSimple
+	BodyCanonicalization   string // DKIMRelaxed (default) or DKIMSimple
+
+	Identity   string        // agent or user identity (i=), optional
+	Expiration time.Duration // signature validity (x=), no expiration if zero
+}
+
+// Sign computes the DKIM signature of the message, which must use CRLF line endings, and
+// returns the DKIM-Signature header to prepend to it, including the final CRLF.
+func (d *DKIMSigner) Sign(msg []byte) ([]byte, error) {
+	algo, err := d.algorithm()
+	if err != nil {
+		return nil, err
+	}
+	hdrCanon, bodyCanon := canonOrDefault(d.HeaderCanonicalization), canonOrDefault(d.BodyCanonicalization)
+
+	fields, body := splitDKIMMessage(msg)
+	bodyHash := sha256.Sum256(canonicalBody(body, bodyCanon))
+
+	// select header fields, from the bottom of the header for repeated fields
+	var names []string
+	var signed [][]byte
+	picker := newHeaderPicker(fields)
+	for _, name := range d.headers() {
+		for {
+			f := picker.next(name)
+			if f == nil {
+				break
+			}
+			names = append(names, name)
+			signed = append(signed, f)
+		}
+	}
+	for _, name := range d.Oversign {
+		names = append(names, name)
+	}
+
+	now := time.Now()
+	tags := []string{
+		"v=1",
+		"a=" + algo,
+		"c=" + hdrCanon + "/" + bodyCanon,
+		"d=" + d.Domain,
+		"s=" + d.Selector,
+	}
+	if d.Identity != "" {
+		tags = append(tags, "i="+d.Identity)
+	}
+	tags = append(tags, "t="+strconv.FormatInt(now.Unix(), 10))
+	if d.Expiration > 0 {
+		tags = append(tags, "x="+strconv.FormatInt(now.Add(d.Expiration).Unix(), 10))
+	}
+	tags = append(tags,
+		"h="+strings.ToLower(strings.Join(names, ":")),
+		"bh="+base64.StdEncoding.EncodeToString(bodyHash[:]),
+		"b=",
+	)
+	sigHdr := foldDKIMTags(tags)
+
+	h := sha256.New()
+	for _, f := range signed {
+		h.Write(canonicalHeader(f, hdrCanon))
+	}
+	h.Write(bytes.TrimSuffix(canonicalHeader(sigHdr, hdrCanon), []byte("\r\n")))
+
+	var sig []byte
+	if algo == "ed25519-sha256" {
+		sig, err = d.Key.Sign(rand.Reader, h.Sum(nil), crypto.Hash(0))
+	} else {
+		sig, err = d.Key.Sign(rand.Reader, h.Sum(nil), crypto.SHA256)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// append the signature, folded on multiple lines
+	res := bytes.NewBuffer(sigHdr[:len(sigHdr)-2])
+	b64 := base64.StdEncoding.EncodeToString(sig)
+	for len(b64) > 72 {
+		res.WriteString(b64[:72])
+		res.WriteString("\r\n\t")
+		b64 = b64[72:]
+	}
+	res.WriteString(b64)
+	res.WriteString("\r\n")
+	return res.Bytes(), nil
+}
+
+// DNSRecord returns the TXT record to publish at <Selector>._domainkey.<Domain> for
+// receivers to verify the signatures
+func (d *DKIMSigner) DNSRecord() (string, error) {
+	switch pub := d.Key.Public().(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return "", err
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub), nil
+	default:
+		return "", errors.New("dkim: unsupported key type")
+	}
+}
+
+func (d *DKIMSigner) algorithm() (string, error) {
+	switch d.Key.Public().(type) {
+	case *rsa.PublicKey:
+		return "rsa-sha256", nil
+	case ed25519.PublicKey:
+		return "ed25519-sha256", nil
+	default:
+		return "", errors.New("dkim: unsupported key type")
+	}
+}
+
+func (d *DKIMSigner) headers() []string {
+	if d.Headers == nil {
+		return DefaultDKIMHeaders
+	}
+	return d.Headers
+}
+
+// DKIMSender signs messages before sending them through another Sender
+type DKIMSender struct {
+	Sender Sender
+	Signer *DKIMSigner
+}
+
+// Send signs the message and sends it
+func (s *DKIMSender) Send(from string, to []string, msg io.WriterTo) error {
+	return s.SendContext(context.Background(), NewEnvelope(from, to...), msg)
+}
+
+// SendContext signs the message and sends it using the given envelope
+func (s *DKIMSender) SendContext(ctx context.Context, env *Envelope, msg io.WriterTo) error {
+	signed, err := s.sign(msg)
+	if err != nil {
+		return err
+	}
+	return sendContext(ctx, s.Sender, env, signed)
+}
+
+// Deliver signs the message and sends it, returning the result for each recipient as reported
+// by the underlying sender if it implements ResultSender
+func (s *DKIMSender) Deliver(ctx context.Context, env *Envelope, msg io.WriterTo) (*SendResult, error) {
+	signed, err := s.sign(msg)
+	if err != nil {
+		return nil, err
+	}
+	if rs, ok := s.Sender.(ResultSender); ok {
+		return rs.Deliver(ctx, env, signed)
+	}
+	if err := sendContext(ctx, s.Sender, env, signed); err != nil {
+		return nil, err
+	}
+	return &SendResult{Accepted: env.Addresses()}, nil
+}
+
+// RecipientsFromHeaders returns true if the underlying sender reads the recipients from the
+// message headers
+func (s *DKIMSender) RecipientsFromHeaders() bool {
+	rh, ok := s.Sender.(RecipientsFromHeaders)
+	return ok && rh.RecipientsFromHeaders()
+}
+
+// sign renders msg and returns it with a DKIM-Signature header prepended
+func (s *DKIMSender) sign(msg io.WriterTo) (io.WriterTo, error) {
+	buf := &bytes.Buffer{}
+	if _, err := msg.WriteTo(buf); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+	if !verifycrlf(data) {
+		data = fixcrlf(data)
+	}
+	sig, err := s.Signer.Sign(data)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(append(sig, data...)), nil
+}
+
+// splitDKIMMessage splits a message into its raw header fields (including continuation lines
+// and the final CRLF) and its body
+func splitDKIMMessage(msg []byte) ([][]byte, []byte) {
+	var fields [][]byte
+	for len(msg) > 0 {
+		if bytes.HasPrefix(msg, []byte("\r\n")) {
+			return fields, msg[2:]
+		}
+		// find end of field, including continuation lines
+		end := 0
+		for {
+			pos := bytes.Index(msg[end:], []byte("\r\n"))
+			if pos == -1 {
+				end = len(msg)
+				break
+			}
+			end += pos + 2
+			if end >= len(msg) || (msg[end] != ' ' && msg[end] != '\t') {
+				break
+			}
+		}
+		fields = append(fields, msg[:end])
+		msg = msg[end:]
+	}
+	return fields, nil
+}
+
+// headerPicker returns header fields by name, starting from the bottom of the header as
+// required by RFC 6376 5.4.2
+type headerPicker struct {
+	fields [][]byte
+	used   []bool
+}
+
+func newHeaderPicker(fields [][]byte) *headerPicker {
+	return &headerPicker{fields: fields, used: make([]bool, len(fields))}
+}
+
+func (p *headerPicker) next(name string) []byte {
+	for i := len(p.fields) - 1; i >= 0; i-- {
+		if p.used[i] {
+			continue
+		}
+		k, _, ok := bytes.Cut(p.fields[i], []byte(":"))
+		if ok && strings.EqualFold(strings.TrimRight(string(k), " \t"), name) {
+			p.used[i] = true
+			return p.fields[i]
+		}
+	}
+	return nil
+}
+
+// canonicalHeader returns the canonical form of a header field (RFC 6376 3.4.1 and 3.4.2)
+func canonicalHeader(f []byte, canon string) []byte {
+	if canon == DKIMSimple {
+		return f
+	}
+	k, v, _ := bytes.Cut(f, []byte(":"))
+	res := []byte(strings.ToLower(strings.TrimRight(string(k), " \t")))
+	res = append(res, ':')
+	res = append(res, compactWSP(v)...)
+	return append(res, '\r', '\n')
+}
+
+// compactWSP unfolds v, replaces sequences of whitespace with a single space and removes
+// leading and trailing whitespace
+func compactWSP(v []byte) []byte {
+	res := make([]byte, 0, len(v))
+	space := false
+	for _, c := range v {
+		switch c {
+		case '\r', '\n':
+			continue
+		case ' ', '\t':
+			space = true
+			continue
+		}
+		if space && len(res) > 0 {
+			res = append(res, ' ')
+		}
+		space = false
+		res = append(res, c)
+	}
+	return res
+}
+
+// canonicalBody returns the canonical form of a message body (RFC 6376 3.4.3 and 3.4.4)
+func canonicalBody(body []byte, canon string) []byte {
+	if canon == DKIMRelaxed {
+		lines := bytes.SplitAfter(body, []byte("\r\n"))
+		res := make([]byte, 0, len(body))
+		for _, ln := range lines {
+			eol := bytes.HasSuffix(ln, []byte("\r\n"))
+			ln = bytes.TrimSuffix(ln, []byte("\r\n"))
+			space := false
+			for _, c := range ln {
+				if c == ' ' || c == '\t' {
+					space = true
+					continue
+				}
+				if space {
+					res = append(res, ' ')
+				}
+				space = false
+				res = append(res, c)
+			}
+			if eol {
+				res = append(res, '\r', '\n')
+			}
+		}
+		body = res
+	}
+
+	// remove empty lines at the end of the body, and make sure it ends with CRLF
+	for bytes.HasSuffix(body, []byte("\r\n\r\n")) {
+		body = body[:len(body)-2]
+	}
+	if len(body) > 0 && !bytes.HasSuffix(body, []byte("\r\n")) {
+		body = append(body, '\r', '\n')
+	}
+	if canon == DKIMRelaxed && bytes.Equal(body, []byte("\r\n")) {
+		return nil
+	}
+	if canon == DKIMSimple && len(body) == 0 {
+		return []byte("\r\n")
+	}
+	return body
+}
+
+// foldDKIMTags returns a DKIM-Signature header field containing the given tags, folded to
+// keep lines short
+func foldDKIMTags(tags []string) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString("DKIM-Signature: ")
+	ln := buf.Len()
+	for n, tag := range tags {
+		if n < len(tags)-1 {
+			tag += ";"
+		}
+		if n > 0 {
+			// the signature is always on its own line
+			if ln+len(tag)+1 > hdrSoftLimit || tag == "b=" {
+				buf.WriteString("\r\n\t")
+				ln = 1
+			} else {
+				buf.WriteByte(' ')
+				ln++
+			}
+		}
+		buf.WriteString(tag)
+		ln += len(tag)
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+func canonOrDefault(c string) string {
+	if c == DKIMSimple {
+		return DKIMSimple
+	}
+	return DKIMRelaxed
+}
@@ -0,0 +1,206 @@
+package pmail_test
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/KarpelesLab/pmail"
+	"github.com/KarpelesLab/pmail/pmailtest"
+)
+
+func TestDKIMSign(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	s := &pmail.DKIMSigner{Domain: "example.com", Selector: "test", Key: priv, Oversign: []string{"From"}}
+
+	msg := []byte("From: a@example.com\r\nSubject:  Hi\r\n there\r\nX-Unsigned: 1\r\n\r\nHello  world \r\n\r\n\r\n")
+	hdr, err := s.Sign(msg)
+	if err != nil {
+		t.Fatalf("failed to sign: %s", err)
+	}
+	sigHdr := string(hdr)
+	if !strings.HasPrefix(strings.Join(strings.Fields(sigHdr), " "), "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed; d=example.com; s=test;") {
+		t.Errorf("unexpected header: %s", sigHdr)
+	}
+	if !strings.Contains(sigHdr, " h=from:subject:from;") {
+		t.Errorf("unexpected signed headers: %s", sigHdr)
+	}
+	bh := sha256.Sum256([]byte("Hello world\r\n"))
+	if !strings.Contains(sigHdr, "bh="+base64.StdEncoding.EncodeToString(bh[:])+";") {
+		t.Errorf("unexpected body hash: %s", sigHdr)
+	}
+
+	// check the signature using relaxed canonicalization
+	pos := strings.LastIndex(sigHdr, "b=")
+	sig, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(sigHdr[pos+2:]), ""))
+	if err != nil {
+		t.Fatalf("invalid signature: %s", err)
+	}
+	data := "from:a@example.com\r\nsubject:Hi there\r\ndkim-signature:" + strings.Join(strings.Fields(sigHdr[len("DKIM-Signature:"):pos+2]), " ")
+	h := sha256.Sum256([]byte(data))
+	if !ed25519.Verify(pub, h[:], sig) {
+		t.Errorf("signature does not verify")
+	}
+
+	// signing through a sender
+	c := &pmailtest.Recorder{}
+	m := testMail()
+	if err := m.Send(&pmail.DKIMSender{Sender: c, Signer: s}); err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	if data := c.Last().Data; !bytes.HasPrefix(data, []byte("DKIM-Signature: ")) || !regexp.MustCompile(`\r\n\r\nHello`).Match(data) {
+		t.Errorf("unexpected signed message:\n%s", data)
+	}
+}
+
+func TestDKIMSignRSASimple(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	s := &pmail.DKIMSigner{
+		Domain: "example.com", Selector: "test", Key: key, Headers: []string{"From", "Subject"},
+		HeaderCanonicalization: pmail.DKIMSimple, BodyCanonicalization: pmail.DKIMSimple,
+	}
+
+	msg := []byte("From: a@example.com\r\nSubject:  Hi\r\n there\r\n\r\nHello  world \r\n\r\n\r\n")
+	hdr, err := s.Sign(msg)
+	if err != nil {
+		t.Fatalf("failed to sign: %s", err)
+	}
+	sigHdr := strings.TrimSuffix(string(hdr), "\r\n")
+	if !strings.HasPrefix(strings.Join(strings.Fields(sigHdr), " "), "DKIM-Signature: v=1; a=rsa-sha256; c=simple/simple; d=example.com; s=test;") {
+		t.Errorf("unexpected header: %s", sigHdr)
+	}
+	// simple body canonicalization only removes trailing empty lines
+	bh := sha256.Sum256([]byte("Hello  world \r\n"))
+	if !strings.Contains(sigHdr, "bh="+base64.StdEncoding.EncodeToString(bh[:])+";") {
+		t.Errorf("unexpected body hash: %s", sigHdr)
+	}
+
+	// simple header canonicalization signs the fields as they are
+	pos := strings.LastIndex(sigHdr, "b=")
+	sig, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(sigHdr[pos+2:]), ""))
+	if err != nil {
+		t.Fatalf("invalid signature: %s", err)
+	}
+	h := sha256.Sum256([]byte("From: a@example.com\r\nSubject:  Hi\r\n there\r\n" + sigHdr[:pos+2]))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, h[:], sig); err != nil {
+		t.Errorf("signature does not verify: %s", err)
+	}
+}
+
+func TestDKIMSenderDeliver(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	srv := pmailtest.NewServer()
+	defer srv.Close()
+	srv.FailRcpt("carol@example.com", &pmail.SMTPError{Code: 550, Enhanced: "5.1.1", Message: "No such user"})
+	relay := srv.Sender()
+	relay.PartialDelivery = true
+
+	m := testMail()
+	m.AddCc("carol@example.com")
+	s := &pmail.DKIMSender{Sender: relay, Signer: &pmail.DKIMSigner{Domain: "example.com", Selector: "test", Key: priv}}
+	res, err := m.Deliver(context.Background(), s)
+	if err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	if len(res.Accepted) != 1 || len(res.Rejected) != 1 || res.Rejected[0].Recipient != "carol@example.com" {
+		t.Errorf("unexpected result: %+v", res)
+	}
+	if msg := srv.Last(); msg == nil || !bytes.HasPrefix(msg.Data, []byte("DKIM-Signature: ")) {
+		t.Errorf("expected a signed message, got %+v", msg)
+	}
+}
+
+// fakeTXT serves TXT records from a map
+type fakeTXT map[string]string
+
+func (f fakeTXT) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if v, ok := f[name]; ok {
+		return []string{v}, nil
+	}
+	if name == "fail._domainkey.example.com" {
+		return nil, &net.DNSError{Err: "server failure", Name: name, IsTemporary: true}
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func TestVerifyDKIM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	dns := fakeTXT{}
+	signers := []*pmail.DKIMSigner{
+		{Domain: "example.com", Selector: "rsa", Key: rsaKey, Oversign: []string{"From", "Subject"}},
+		{Domain: "example.com", Selector: "ed", Key: edKey, HeaderCanonicalization: pmail.DKIMSimple, BodyCanonicalization: pmail.DKIMSimple},
+		{Domain: "example.com", Selector: "fail", Key: edKey},
+	}
+	m := testMail()
+	m.SetSubject("Invoice")
+	buf := &bytes.Buffer{}
+	if _, err := m.WriteTo(buf); err != nil {
+		t.Fatalf("failed to write mail: %s", err)
+	}
+	msg := buf.Bytes()
+	for _, s := range signers {
+		rec, err := s.DNSRecord()
+		if err != nil {
+			t.Fatalf("failed to build record: %s", err)
+		}
+		if s.Selector != "fail" {
+			dns[s.Selector+"._domainkey.example.com"] = rec
+		}
+		hdr, err := s.Sign(msg)
+		if err != nil {
+			t.Fatalf("failed to sign: %s", err)
+		}
+		msg = append(hdr, msg...)
+	}
+
+	check := func(msg []byte, expect ...pmail.DKIMStatus) {
+		t.Helper()
+		res, err := pmail.VerifyDKIM(bytes.NewReader(msg), dns)
+		if err != nil {
+			t.Fatalf("failed to verify: %s", err)
+		}
+		if len(res) != len(expect) {
+			t.Fatalf("expected %d results, got %d", len(expect), len(res))
+		}
+		for n, r := range res {
+			if r.Status != expect[n] {
+				t.Errorf("signature %s: expected %s, got %s (%v)", r.Selector, expect[n], r.Status, r.Err)
+			}
+		}
+	}
+
+	// signatures are listed from the most recent
+	check(msg, pmail.DKIMTempError, pmail.DKIMPass, pmail.DKIMPass)
+
+	// modified header
+	check(bytes.Replace(msg, []byte("Subject: Invoice"), []byte("Subject: Invoice!"), 1), pmail.DKIMTempError, pmail.DKIMFail, pmail.DKIMFail)
+
+	// added From header, only detected by the oversigned signature
+	check(append([]byte("From: evil@example.net\r\n"), msg...), pmail.DKIMTempError, pmail.DKIMPass, pmail.DKIMFail)
+
+	// modified body, detected before fetching the key
+	check(bytes.Replace(msg, []byte("Hello"), []byte("Hullo"), 1), pmail.DKIMFail, pmail.DKIMFail, pmail.DKIMFail)
+
+	// whitespace changes only pass with relaxed canonicalization
+	check(bytes.Replace(msg, []byte("Subject: Invoice"), []byte("Subject:  Invoice"), 1), pmail.DKIMTempError, pmail.DKIMFail, pmail.DKIMPass)
+}
@@ -0,0 +1,338 @@
+package pmail
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TXTResolver is used to fetch DKIM public keys. *net.Resolver implements it.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// DKIMStatus is the outcome of the verification of a DKIM signature (RFC 8601 2.7.1)
+type DKIMStatus string
+
+const (
+	DKIMPass      DKIMStatus = "pass"      // signature is valid
+	DKIMFail      DKIMStatus = "fail"      // signature did not verify, or has expired
+	DKIMTempError DKIMStatus = "temperror" // public key could not be fetched, verifying again later may succeed
+	DKIMPermError DKIMStatus = "permerror" // signature or key record is malformed or unsupported
+)
+
+// DKIMResult is the result of the verification of a DKIM signature
+type DKIMResult struct {
+	Status    DKIMStatus
+	Domain    string // signing domain (d=)
+	Selector  string // key selector (s=)
+	Identity  string // agent or user identity (i=)
+	Algorithm string // signing algorithm (a=)
+	Err       error  // reason of the failure, nil if Status is DKIMPass
+}
+
+// VerifyDKIM verifies the DKIM signatures of the message read from r, fetching public keys
+// through resolver (net.DefaultResolver if nil). A result is returned for each signature, and
+// an error only if the message could not be read.
+func VerifyDKIM(r io.Reader, resolver TXTResolver) ([]*DKIMResult, error) {
+	return VerifyDKIMContext(context.Background(), r, resolver)
+}
+
+// VerifyDKIMContext is like VerifyDKIM, using ctx for DNS lookups
+func VerifyDKIMContext(ctx context.Context, r io.Reader, resolver TXTResolver) ([]*DKIMResult, error) {
+	msg, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if !verifycrlf(msg) {
+		msg = fixcrlf(msg)
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	fields, body := splitDKIMMessage(msg)
+	var res []*DKIMResult
+	for _, f := range fields {
+		k, v, _ := bytes.Cut(f, []byte(":"))
+		if !strings.EqualFold(strings.TrimSpace(string(k)), "DKIM-Signature") {
+			continue
+		}
+		sig := &dkimSignature{field: f, raw: string(v)}
+		res = append(res, sig.verify(ctx, resolver, fields, body))
+	}
+	return res, nil
+}
+
+type dkimSignature struct {
+	field []byte // raw header field
+	raw   string // raw value
+	tags  map[string]string
+}
+
+func (s *dkimSignature) verify(ctx context.Context, resolver TXTResolver, fields [][]byte, body []byte) *DKIMResult {
+	res := &DKIMResult{}
+	var err error
+	s.tags, err = parseDKIMTags(s.raw)
+	if err != nil {
+		return res.set(DKIMPermError, err)
+	}
+	res.Domain, res.Selector, res.Algorithm = s.tags["d"], s.tags["s"], s.tags["a"]
+	res.Identity = s.tags["i"]
+
+	for _, t := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if s.tags[t] == "" {
+			return res.set(DKIMPermError, fmt.Errorf("missing tag %s=", t))
+		}
+	}
+	if s.tags["v"] != "1" {
+		return res.set(DKIMPermError, errors.New("unsupported version"))
+	}
+	if res.Algorithm != "rsa-sha256" && res.Algorithm != "ed25519-sha256" {
+		return res.set(DKIMPermError, fmt.Errorf("unsupported algorithm %s", res.Algorithm))
+	}
+	names := strings.Split(s.tags["h"], ":")
+	signsFrom := false
+	for n, name := range names {
+		names[n] = strings.TrimSpace(name)
+		if strings.EqualFold(names[n], "From") {
+			signsFrom = true
+		}
+	}
+	if !signsFrom {
+		return res.set(DKIMPermError, errors.New("From header is not signed"))
+	}
+	if res.Identity != "" {
+		_, idDomain, _ := strings.Cut(res.Identity, "@")
+		if !isSubdomain(idDomain, res.Domain) {
+			return res.set(DKIMPermError, errors.New("identity does not match signing domain"))
+		}
+	}
+	if x := s.tags["x"]; x != "" {
+		exp, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return res.set(DKIMPermError, errors.New("invalid expiration"))
+		}
+		if time.Now().Unix() > exp {
+			return res.set(DKIMFail, errors.New("signature has expired"))
+		}
+	}
+
+	hdrCanon, bodyCanon := DKIMSimple, DKIMSimple
+	if c := s.tags["c"]; c != "" {
+		h, b, ok := strings.Cut(c, "/")
+		hdrCanon = h
+		if ok {
+			bodyCanon = b
+		}
+		for _, v := range []string{hdrCanon, bodyCanon} {
+			if v != DKIMSimple && v != DKIMRelaxed {
+				return res.set(DKIMPermError, fmt.Errorf("unsupported canonicalization %s", c))
+			}
+		}
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(stripFWS(s.tags["b"]))
+	if err != nil {
+		return res.set(DKIMPermError, errors.New("invalid signature encoding"))
+	}
+	bh, err := base64.StdEncoding.DecodeString(stripFWS(s.tags["bh"]))
+	if err != nil {
+		return res.set(DKIMPermError, errors.New("invalid body hash encoding"))
+	}
+
+	// body hash
+	cbody := canonicalBody(body, bodyCanon)
+	if l := s.tags["l"]; l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			return res.set(DKIMPermError, errors.New("invalid body length"))
+		}
+		if n > len(cbody) {
+			return res.set(DKIMFail, errors.New("body is shorter than signed length"))
+		}
+		cbody = cbody[:n]
+	}
+	if sum := sha256.Sum256(cbody); !bytes.Equal(sum[:], bh) {
+		return res.set(DKIMFail, errors.New("body hash does not match"))
+	}
+
+	key, err := fetchDKIMKey(ctx, resolver, res.Selector, res.Domain)
+	if err != nil {
+		return res.set(dkimKeyStatus(err), err)
+	}
+
+	// header hash
+	h := sha256.New()
+	picker := newHeaderPicker(fields)
+	for _, name := range names {
+		if f := picker.next(name); f != nil {
+			h.Write(canonicalHeader(f, hdrCanon))
+		}
+	}
+	h.Write(bytes.TrimSuffix(canonicalHeader(removeDKIMSignature(s.field), hdrCanon), []byte("\r\n")))
+	hash := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if res.Algorithm != "rsa-sha256" {
+			return res.set(DKIMPermError, errors.New("key type does not match algorithm"))
+		}
+		if pub.N.BitLen() < 1024 {
+			return res.set(DKIMPermError, errors.New("RSA key is too short"))
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash, sig); err != nil {
+			return res.set(DKIMFail, errors.New("signature does not verify"))
+		}
+	case ed25519.PublicKey:
+		if res.Algorithm != "ed25519-sha256" {
+			return res.set(DKIMPermError, errors.New("key type does not match algorithm"))
+		}
+		if !ed25519.Verify(pub, hash, sig) {
+			return res.set(DKIMFail, errors.New("signature does not verify"))
+		}
+	}
+	res.Status = DKIMPass
+	return res
+}
+
+func (r *DKIMResult) set(status DKIMStatus, err error) *DKIMResult {
+	r.Status = status
+	r.Err = err
+	return r
+}
+
+// errDKIMTempKey wraps errors that prevented fetching a key but may not happen again
+type errDKIMTempKey struct{ err error }
+
+func (e *errDKIMTempKey) Error() string { return "key lookup failed: " + e.err.Error() }
+func (e *errDKIMTempKey) Unwrap() error { return e.err }
+
+func dkimKeyStatus(err error) DKIMStatus {
+	var tmp *errDKIMTempKey
+	if errors.As(err, &tmp) {
+		return DKIMTempError
+	}
+	return DKIMPermError
+}
+
+// fetchDKIMKey fetches and parses the public key record for the given selector and domain
+func fetchDKIMKey(ctx context.Context, resolver TXTResolver, selector, domain string) (crypto.PublicKey, error) {
+	txts, err := resolver.LookupTXT(ctx, selector+"._domainkey."+domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, errors.New("no key for signature")
+		}
+		return nil, &errDKIMTempKey{err}
+	}
+	// use the first record that looks like a key, other records may exist for other purposes
+	var tags map[string]string
+	for _, txt := range txts {
+		t, err := parseDKIMTags(txt)
+		if _, hasKey := t["p"]; err == nil && hasKey {
+			tags = t
+			break
+		}
+	}
+	if tags == nil {
+		return nil, errors.New("no valid key record for signature")
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, errors.New("unsupported key record version")
+	}
+	p := stripFWS(tags["p"])
+	if p == "" {
+		return nil, errors.New("key has been revoked")
+	}
+	data, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, errors.New("invalid key encoding")
+	}
+
+	switch k := tags["k"]; k {
+	case "", "rsa":
+		if pub, err := x509.ParsePKIXPublicKey(data); err == nil {
+			if rsaPub, ok := pub.(*rsa.PublicKey); ok {
+				return rsaPub, nil
+			}
+			return nil, errors.New("key is not a RSA key")
+		}
+		// some records contain a PKCS #1 key instead of a SubjectPublicKeyInfo
+		pub, err := x509.ParsePKCS1PublicKey(data)
+		if err != nil {
+			return nil, errors.New("invalid RSA key")
+		}
+		return pub, nil
+	case "ed25519":
+		if len(data) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(data), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k)
+	}
+}
+
+// parseDKIMTags parses a tag list such as "v=1; a=rsa-sha256" (RFC 6376 3.2)
+func parseDKIMTags(s string) (map[string]string, error) {
+	res := make(map[string]string)
+	for _, t := range strings.Split(s, ";") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(t, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed tag %q", t)
+		}
+		k = strings.TrimSpace(k)
+		if _, dup := res[k]; dup {
+			return nil, fmt.Errorf("duplicate tag %s=", k)
+		}
+		res[k] = strings.TrimSpace(v)
+	}
+	return res, nil
+}
+
+// removeDKIMSignature returns the DKIM-Signature header field with the value of its b= tag
+// removed, as used when computing the header hash
+func removeDKIMSignature(f []byte) []byte {
+	k, v, _ := bytes.Cut(f, []byte(":"))
+	parts := bytes.Split(v, []byte(";"))
+	for n, p := range parts {
+		name, _, ok := bytes.Cut(p, []byte("="))
+		if ok && string(bytes.TrimSpace(name)) == "b" {
+			pos := bytes.IndexByte(p, '=')
+			parts[n] = p[:pos+1]
+			if n == len(parts)-1 && bytes.HasSuffix(p, []byte("\r\n")) {
+				// keep the end of the field
+				parts[n] = append(parts[n][:pos+1:pos+1], '\r', '\n')
+			}
+		}
+	}
+	res := append(append(k[:len(k):len(k)], ':'), bytes.Join(parts, []byte(";"))...)
+	return res
+}
+
+// stripFWS removes whitespace found in base64 values
+func stripFWS(s string) string {
+	return strings.Join(strings.Fields(s), "")
+}
+
+func isSubdomain(sub, domain string) bool {
+	sub, domain = strings.ToLower(sub), strings.ToLower(domain)
+	return sub == domain || strings.HasSuffix(sub, "."+domain)
+}
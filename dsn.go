@@ -0,0 +1,87 @@
+package pmail
+
+import "strings"
+
+// DSN return and notification values (RFC 3461)
+const (
+	RetFull    = "FULL" // return the full message in notifications
+	RetHeaders = "HDRS" // return only the headers of the message
+
+	NotifyNever   = "NEVER"
+	NotifySuccess = "SUCCESS"
+	NotifyFailure = "FAILURE"
+	NotifyDelay   = "DELAY"
+)
+
+// DSNRequest holds the delivery status notifications requested for an email. These are only
+// honored by servers supporting the DSN extension (RFC 3461).
+type DSNRequest struct {
+	Ret    string   // RetFull or RetHeaders, defaults to the server's choice
+	EnvID  string   // envelope identifier returned in notifications, defaults to the Message-Id
+	Notify []string // conditions for which notifications are sent, for all recipients
+}
+
+// RequestDSN requests delivery status notifications for the given conditions, such as
+// NotifyFailure and NotifyDelay, returning the message as specified by ret.
+func (m *Mail) RequestDSN(ret string, notify ...string) {
+	m.DSN = &DSNRequest{Ret: ret, Notify: notify}
+}
+
+// apply sets the DSN parameters of env. Recipients get an ORCPT so notifications can be
+// matched to the original address even after forwarding.
+func (d *DSNRequest) apply(env *Envelope, messageId string) {
+	env.Ret = d.Ret
+	env.EnvID = d.EnvID
+	if env.EnvID == "" {
+		env.EnvID = messageId
+	}
+	for _, rcpt := range env.Recipients {
+		if len(rcpt.Notify) == 0 {
+			rcpt.Notify = d.Notify
+		}
+		if rcpt.ORCPT == "" && isASCII(rcpt.Address) {
+			rcpt.ORCPT = "rfc822;" + rcpt.Address
+		}
+	}
+}
+
+// dsnMailParams returns the MAIL FROM parameters requesting notifications for env
+func dsnMailParams(env *Envelope) []string {
+	var params []string
+	if env.Ret != "" {
+		params = append(params, "RET="+strings.ToUpper(env.Ret))
+	}
+	if env.EnvID != "" {
+		params = append(params, "ENVID="+xtext(env.EnvID))
+	}
+	return params
+}
+
+// dsnRcptParams returns the RCPT TO parameters requesting notifications for rcpt
+func dsnRcptParams(rcpt *Recipient) []string {
+	var params []string
+	if len(rcpt.Notify) > 0 {
+		params = append(params, "NOTIFY="+strings.ToUpper(strings.Join(rcpt.Notify, ",")))
+	}
+	if rcpt.ORCPT != "" {
+		params = append(params, "ORCPT="+xtext(rcpt.ORCPT))
+	}
+	return params
+}
+
+// xtext encodes s as described in RFC 3461 4.
+func xtext(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '!' || c > '~' || c == '+' || c == '=' {
+			b.WriteByte('+')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&0xf])
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,221 @@
+package pmail
+
+import (
+	"encoding/base64"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+)
+
+// RFC 2047 encoded-words, used for non-ASCII text in headers
+
+const (
+	encWordMaxLen = 75 // RFC 2047 2. An 'encoded-word' may not be more than 75 characters long
+	encWordPrefix = "=?utf-8?"
+	encWordSuffix = "?="
+)
+
+// addrHeaders lists headers containing address lists, where only display names may be encoded
+var addrHeaders = map[string]bool{
+	"From":          true,
+	"Sender":        true,
+	"Reply-To":      true,
+	"To":            true,
+	"Cc":            true,
+	"Bcc":           true,
+	"Resent-From":   true,
+	"Resent-Sender": true,
+	"Resent-To":     true,
+	"Resent-Cc":     true,
+	"Resent-Bcc":    true,
+}
+
+// textHeaders lists the unstructured headers holding free text, where non-ASCII words are
+// encoded. Extension headers (X-*) are treated as such too. Other headers, including unknown
+// ones such as List-Unsubscribe or Authentication-Results, are never encoded as their syntax
+// is unknown.
+var textHeaders = map[string]bool{
+	"Subject":  true,
+	"Comments": true,
+	"Keywords": true,
+}
+
+// structHeaders lists structured headers that can be folded at their delimiters
+var structHeaders = map[string]bool{
+	"Date":                      true,
+	"Message-Id":                true,
+	"In-Reply-To":               true,
+	"References":                true,
+	"Received":                  true,
+	"Return-Path":               true,
+	"Mime-Version":              true,
+	"Content-Type":              true,
+	"Content-Disposition":       true,
+	"Content-Transfer-Encoding": true,
+	"Content-Id":                true,
+	"Dkim-Signature":            true,
+}
+
+// isUnstructured returns true if the given (canonical) header key holds free text
+func isUnstructured(k string) bool {
+	return textHeaders[k] || strings.HasPrefix(k, "X-")
+}
+
+// needsEncoding returns true if s contains characters that cannot appear as is in a header,
+// or text that could be mistaken for an encoded-word
+func needsEncoding(s string) bool {
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		if (b < ' ' && b != '\t') || b >= 0x7f {
+			return true
+		}
+	}
+	for _, w := range strings.Fields(s) {
+		if strings.HasPrefix(w, "=?") && strings.HasSuffix(w, "?=") {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeText encodes the words of an unstructured header value that need it, as well as words
+// longer than maxLen that could not fit on a line otherwise, since encoded-words can be split
+// and folded. Runs of consecutive words needing encoding are encoded together since whitespace
+// between adjacent encoded-words is ignored when decoding.
+func encodeText(s string, maxLen int) string {
+	words := strings.Split(s, " ")
+	encode := func(w string) bool {
+		return len(w) > maxLen || needsEncoding(w)
+	}
+	res := make([]string, 0, len(words))
+
+	for i := 0; i < len(words); i++ {
+		if !encode(words[i]) {
+			res = append(res, words[i])
+			continue
+		}
+		j := i + 1
+		for j < len(words) && encode(words[j]) {
+			j++
+		}
+		res = append(res, encodeWord(strings.Join(words[i:j], " "), false)...)
+		i = j - 1
+	}
+	return strings.Join(res, " ")
+}
+
+// encodeWord returns s as a list of RFC 2047 encoded-words, using whichever of the B or Q
+// encodings is shorter. If phrase is true, the Q encoding is restricted to the characters
+// allowed in a phrase (RFC 2047 5.3), as needed for display names.
+func encodeWord(s string, phrase bool) []string {
+	b := encodeWordB(s)
+	q := encodeWordQ(s, phrase)
+
+	if encWordsLen(q) <= encWordsLen(b) {
+		return q
+	}
+	return b
+}
+
+func encWordsLen(words []string) int {
+	l := 0
+	for _, w := range words {
+		l += len(w) + 1
+	}
+	return l
+}
+
+func encodeWordB(s string) []string {
+	// each word can hold floor(payload/4)*3 bytes of data
+	max := (encWordMaxLen - len(encWordPrefix) - len(encWordSuffix) - 2) / 4 * 3
+
+	var res []string
+	for len(s) > 0 {
+		n := 0
+		for n < len(s) {
+			_, sz := utf8.DecodeRuneInString(s[n:])
+			if n+sz > max {
+				break
+			}
+			n += sz
+		}
+		res = append(res, encWordPrefix+"b?"+base64.StdEncoding.EncodeToString([]byte(s[:n]))+encWordSuffix)
+		s = s[n:]
+	}
+	return res
+}
+
+func encodeWordQ(s string, phrase bool) []string {
+	const hex = "0123456789ABCDEF"
+	max := encWordMaxLen - len(encWordPrefix) - len(encWordSuffix) - 2
+
+	var res []string
+	var buf, enc []byte
+
+	for len(s) > 0 {
+		// encode one rune at a time so words are never split in the middle of a character
+		_, sz := utf8.DecodeRuneInString(s)
+		enc = enc[:0]
+		for _, c := range []byte(s[:sz]) {
+			switch {
+			case c == ' ':
+				enc = append(enc, '_')
+			case qSafe(c, phrase):
+				enc = append(enc, c)
+			default:
+				enc = append(enc, '=', hex[c>>4], hex[c&0xf])
+			}
+		}
+		s = s[sz:]
+
+		if len(buf)+len(enc) > max {
+			res = append(res, encWordPrefix+"q?"+string(buf)+encWordSuffix)
+			buf = buf[:0]
+		}
+		buf = append(buf, enc...)
+	}
+	if len(buf) > 0 {
+		res = append(res, encWordPrefix+"q?"+string(buf)+encWordSuffix)
+	}
+	return res
+}
+
+// qSafe returns true if c can appear unencoded in a Q encoded-word
+func qSafe(c byte, phrase bool) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	case phrase:
+		return strings.IndexByte("!*+-/", c) != -1
+	default:
+		return c > ' ' && c < 0x7f && c != '=' && c != '?' && c != '_'
+	}
+}
+
+// encodeAddressList re-formats an address list, encoding display names when needed and
+// leaving the addr-spec untouched. It returns false if the value could not be parsed.
+func encodeAddressList(v string) (string, bool) {
+	list, err := mail.ParseAddressList(v)
+	if err != nil {
+		return "", false
+	}
+	res := make([]string, len(list))
+	for n, a := range list {
+		if needsEncoding(a.Name) {
+			res[n] = strings.Join(encodeWord(a.Name, true), " ") + " " + (&mail.Address{Address: a.Address}).String()
+		} else {
+			res[n] = a.String()
+		}
+	}
+	return strings.Join(res, ", "), true
+}
+
+// formatAddress returns the address in a form suitable for storage in a Header. Unlike
+// mail.Address.String, display names are not encoded as this happens in Header.Encode.
+func formatAddress(a *mail.Address) string {
+	if !needsEncoding(a.Name) {
+		return a.String()
+	}
+	name := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(a.Name)
+	return `"` + name + `" ` + (&mail.Address{Address: a.Address}).String()
+}
@@ -0,0 +1,92 @@
+package pmail
+
+import (
+	"context"
+	"io"
+)
+
+// Envelope holds the SMTP envelope of a message: the return path given in MAIL FROM and the
+// recipients given in RCPT TO. These do not need to match the message headers, for example
+// bounces can be sent to a VERP address different from the From header.
+type Envelope struct {
+	From         string       // return path, empty for the null sender (used for bounces)
+	Recipients   []*Recipient // envelope recipients
+	SMTPUTF8     bool         // addresses or headers contain UTF-8 (RFC 6531)
+	EightBitMIME bool         // message contains 8bit data (RFC 6152)
+	Ret          string       // DSN: RetFull or RetHeaders, how much of the message to return in notifications (RFC 3461)
+	EnvID        string       // DSN: envelope identifier, returned in notifications
+}
+
+// Recipient is an envelope recipient along with its per-recipient options
+type Recipient struct {
+	Address string
+	Notify  []string // DSN notification conditions: NotifyNever, or any of NotifySuccess, NotifyFailure, NotifyDelay
+	ORCPT   string   // DSN original recipient, as "rfc822;user@example.com"
+}
+
+// EnvelopeSender is implemented by senders able to use the full envelope information
+type EnvelopeSender interface {
+	Sender
+	SendEnvelope(env *Envelope, msg io.WriterTo) error
+}
+
+// NewEnvelope returns a simple envelope for the given sender and recipients
+func NewEnvelope(from string, to ...string) *Envelope {
+	env := &Envelope{From: from}
+	for _, t := range to {
+		env.Recipients = append(env.Recipients, &Recipient{Address: t})
+	}
+	env.SMTPUTF8 = !isASCII(from) || !isASCII(to...)
+	return env
+}
+
+// Addresses returns the list of recipient addresses
+func (e *Envelope) Addresses() []string {
+	res := make([]string, len(e.Recipients))
+	for n, r := range e.Recipients {
+		res[n] = r.Address
+	}
+	return res
+}
+
+// DefaultEnvelope returns the envelope used when sending this email, built from the From
+// address and the To, Cc and Bcc recipients. EightBitMIME is set if the message uses 8bit parts,
+// and the DSN parameters are set if requested through m.DSN.
+func (m *Mail) DefaultEnvelope() *Envelope {
+	from := ""
+	if m.From != nil {
+		from = m.From.Address
+	}
+	env := NewEnvelope(from, m.Recipients()...)
+	env.EightBitMIME = m.Body.Uses8Bit()
+	if m.DSN != nil {
+		m.DSN.apply(env, m.messageId())
+	}
+	return env
+}
+
+// sendContext sends msg through s, using the context and full envelope if supported by s
+func sendContext(ctx context.Context, s Sender, env *Envelope, msg io.WriterTo) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	switch cs := s.(type) {
+	case ContextSender:
+		return cs.SendContext(ctx, env, msg)
+	case EnvelopeSender:
+		return cs.SendEnvelope(env, msg)
+	default:
+		return s.Send(env.From, env.Addresses(), msg)
+	}
+}
+
+func isASCII(s ...string) bool {
+	for _, v := range s {
+		for i := 0; i < len(v); i++ {
+			if v[i] >= 0x80 {
+				return false
+			}
+		}
+	}
+	return true
+}
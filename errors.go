@@ -3,6 +3,10 @@ package pmail
 import "errors"
 
 var (
-	ErrInvalidEmail  = errors.New("email is not valid (missing headers or body)")
-	ErrPartHasNoBody = errors.New("email part has no body (or is already consumed)")
+	ErrInvalidEmail    = errors.New("email is not valid (missing headers or body)")
+	ErrPartHasNoBody   = errors.New("email part has no body (or is already consumed)")
+	ErrMissingBoundary = errors.New("multipart part has no boundary parameter")
+	ErrNotDSN          = errors.New("email is not a delivery status notification")
+	ErrNotSent         = errors.New("message not sent because other recipients were rejected")
+	ErrHeaderTooLong   = errors.New("header cannot be folded within the line length limit")
 )
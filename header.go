@@ -54,7 +54,7 @@ func (h Header) SetAddressList(key string, value []*mail.Address) {
 		if n > 0 {
 			buf.WriteString(", ")
 		}
-		buf.WriteString(a.String())
+		buf.WriteString(formatAddress(a))
 	}
 	h.Set(key, buf.String())
 }
@@ -67,7 +67,10 @@ func (h Header) AddressList(key string) ([]*mail.Address, error) {
 	return mail.ParseAddressList(hdr)
 }
 
-func (h Header) Encode(exclude ...string) []byte {
+// Encode returns the headers formatted for a message, folded and with non-ASCII text encoded as
+// needed. Headers listed in exclude are skipped. An error is returned if a header cannot be
+// written within the line length limit of RFC 5322.
+func (h Header) Encode(exclude ...string) ([]byte, error) {
 	// build an exclude map
 	excl := make(map[string]bool)
 	for _, v := range exclude {
@@ -88,25 +91,100 @@ func (h Header) Encode(exclude ...string) []byte {
 	sort.Strings(keys)
 
 	for _, k := range keys {
-		v := h[k]
+		for _, s := range h[k] {
+			if err := smartEncodeHeader(buf, k, s); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
 
-		switch k {
-		case "Subject", "From", "To", "Cc":
-			for _, s := range v {
-				smartEncodeHeader(buf, k, s)
+// smartEncodeHeader writes the given header, applying RFC 2047 encoding to non-ASCII
+// text in unstructured headers and display names of address headers. Other headers are
+// written as is, only folded at existing whitespace.
+func smartEncodeHeader(buf *bytes.Buffer, k string, v string) error {
+	switch {
+	case addrHeaders[k]:
+		if needsEncoding(v) {
+			if enc, ok := encodeAddressList(v); ok {
+				v = enc
 			}
-		default:
-			for _, s := range v {
-				fmt.Fprintf(buf, "%s: %s\r\n", k, s)
+		}
+	case isUnstructured(k):
+		// words too long for the first line are encoded as well so they can be folded
+		v = encodeText(v, hdrHardLimit-len(k)-2)
+	}
+	return foldHeader(buf, k, v, addrHeaders[k] || structHeaders[k])
+}
+
+const (
+	hdrSoftLimit = 78  // RFC 5322 2.1.1. Each line SHOULD be no more than 78 characters, excluding the CRLF
+	hdrHardLimit = 998 // RFC 5322 2.1.1. Each line MUST be no more than 998 characters, excluding the CRLF
+)
+
+// foldHeader writes the header, folding it so lines stay under hdrSoftLimit where possible.
+// Unstructured values are only folded at existing whitespace, while structured values can
+// also be folded after commas and between angle-bracketed items such as message ids. An error
+// is returned if a part of the value cannot fit within hdrHardLimit.
+func foldHeader(buf *bytes.Buffer, k string, v string, structured bool) error {
+	buf.WriteString(k)
+	buf.WriteString(":")
+	ln := len(k) + 1
+
+	first := true
+	for _, tok := range splitHeaderTokens(" "+v, structured) {
+		if !first && ln+len(tok) > hdrSoftLimit {
+			buf.WriteString("\r\n")
+			ln = 0
+			if tok[0] != ' ' && tok[0] != '\t' {
+				buf.WriteByte(' ')
+				ln = 1
 			}
 		}
+		first = false
+
+		if ln+len(tok) > hdrHardLimit {
+			// splitting the token would alter the value
+			return fmt.Errorf("%w: %s", ErrHeaderTooLong, k)
+		}
+		buf.WriteString(tok)
+		ln += len(tok)
 	}
-	return buf.Bytes()
+	buf.WriteString("\r\n")
+	return nil
 }
 
-func smartEncodeHeader(buf *bytes.Buffer, k string, v string) {
-	// TODO
-	fmt.Fprintf(buf, "%s: %s\r\n", k, v)
+// splitHeaderTokens splits v at the positions where folding is allowed, never inside a
+// quoted-string. Whitespace is kept at the start of the token that follows it.
+func splitHeaderTokens(v string, structured bool) []string {
+	var res []string
+	start := 0
+	quoted := false
+
+	for i := 1; i < len(v); i++ {
+		c, pc := v[i], v[i-1]
+		switch {
+		case quoted:
+			if c == '"' && pc != '\\' {
+				quoted = false
+			}
+			continue
+		case c == '"':
+			quoted = true
+		}
+
+		isWsp := c == ' ' || c == '\t'
+		brk := isWsp && pc != ' ' && pc != '\t'
+		if structured && !isWsp {
+			brk = brk || pc == ',' || (pc == '>' && c == '<')
+		}
+		if brk {
+			res = append(res, v[start:i])
+			start = i
+		}
+	}
+	return append(res, v[start:])
 }
 
 // Merge will duplicate the header object and add another object
@@ -9,35 +9,33 @@ type lineBreaker struct {
 	out  io.Writer
 }
 
-func newStdLinebreaker(w io.Writer) io.WriteCloser {
-	return &lineBreaker{line: make([]byte, 78), eol: []byte{'\r', '\n'}}
+// newStdLinebreaker returns a writer that inserts a CRLF every 76 characters, as
+// required for base64 data (RFC 2045 6.8)
+func newStdLinebreaker(w io.Writer) *lineBreaker {
+	return &lineBreaker{line: make([]byte, 76), eol: []byte{'\r', '\n'}, out: w}
 }
 
 func (l *lineBreaker) Write(b []byte) (n int, err error) {
-	if l.used+len(b) < len(l.line) {
-		copy(l.line[l.used:], b)
-		l.used += len(b)
-		return len(b), nil
-	}
-
-	n, err = l.out.Write(l.line[0:l.used])
-	if err != nil {
-		return
-	}
-	excess := len(l.line) - l.used
-	l.used = 0
+	for len(b) > 0 {
+		c := copy(l.line[l.used:], b)
+		l.used += c
+		n += c
+		b = b[c:]
 
-	n, err = l.out.Write(b[0:excess])
-	if err != nil {
-		return
-	}
+		if l.used < len(l.line) {
+			break
+		}
 
-	n, err = l.out.Write(l.eol)
-	if err != nil {
-		return
+		// line is full
+		l.used = 0
+		if _, err = l.out.Write(l.line); err != nil {
+			return
+		}
+		if _, err = l.out.Write(l.eol); err != nil {
+			return
+		}
 	}
-
-	return l.Write(b[excess:])
+	return
 }
 
 func (l *lineBreaker) Close() (err error) {
@@ -47,7 +45,22 @@ func (l *lineBreaker) Close() (err error) {
 			return
 		}
 		_, err = l.out.Write(l.eol)
+		l.used = 0
 	}
 
 	return
 }
+
+// chainCloser is a writer that closes another writer (typically the one it writes to)
+// after itself.
+type chainCloser struct {
+	io.WriteCloser
+	next io.Closer
+}
+
+func (c *chainCloser) Close() error {
+	if err := c.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return c.next.Close()
+}
@@ -0,0 +1,129 @@
+package pmail
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// LMTPSender delivers emails to a mail store using LMTP (RFC 2033), over TCP or a unix socket.
+// Unlike SMTP, the server reports the outcome of the delivery for each recipient.
+type LMTPSender struct {
+	Network   string // "tcp" or "unix", defaults to "unix" if Addr contains a slash
+	Addr      string // host:port or path of the socket
+	Auth      smtp.Auth
+	LocalName string // name sent in LHLO, defaults to localhost
+
+	// PartialDelivery allows sending the email to the accepted recipients when some others
+	// are rejected in RCPT. Recipients refusing the message after its transmission do not
+	// prevent delivery to the others.
+	PartialDelivery bool
+
+	DialTimeout    time.Duration // timeout for establishing the connection, defaults to 30 seconds
+	CommandTimeout time.Duration // timeout for each command, defaults to 5 minutes
+	DataTimeout    time.Duration // timeout for transmitting the message, defaults to 10 minutes
+}
+
+// Send connects to the LMTP server and delivers the email
+func (l *LMTPSender) Send(from string, to []string, msg io.WriterTo) error {
+	return l.SendContext(context.Background(), NewEnvelope(from, to...), msg)
+}
+
+// SendEnvelope connects to the LMTP server and delivers the email using the given envelope
+func (l *LMTPSender) SendEnvelope(env *Envelope, msg io.WriterTo) error {
+	return l.SendContext(context.Background(), env, msg)
+}
+
+// SendContext connects to the LMTP server and delivers the email using the given envelope. An
+// error is returned if any recipient rejected the email.
+func (l *LMTPSender) SendContext(ctx context.Context, env *Envelope, msg io.WriterTo) error {
+	res, err := l.Deliver(ctx, env, msg)
+	if err != nil {
+		return err
+	}
+	return res.Err()
+}
+
+// Deliver connects to the LMTP server and delivers the email, returning the result for each
+// recipient as reported by the server after the transmission of the message.
+func (l *LMTPSender) Deliver(ctx context.Context, env *Envelope, msg io.WriterTo) (*SendResult, error) {
+	res, err := l.deliver(ctx, env, msg)
+	if err != nil && ctx.Err() != nil {
+		return res, ctx.Err()
+	}
+	return res, err
+}
+
+func (l *LMTPSender) deliver(ctx context.Context, env *Envelope, msg io.WriterTo) (*SendResult, error) {
+	cl, err := l.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cl.close()
+	defer watchContext(ctx, cl.conn)()
+
+	res, err := sendSMTPEnvelope(cl, env, msg, l.PartialDelivery)
+	if err != nil {
+		return res, err
+	}
+
+	cl.quit()
+	return res, nil
+}
+
+// dial connects to the server and returns a session ready to send emails
+func (l *LMTPSender) dial(ctx context.Context) (*smtpClient, error) {
+	network, host := l.network(), "localhost"
+	if network != "unix" {
+		if h, _, err := net.SplitHostPort(l.Addr); err == nil {
+			host = h
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: timeoutOrDefault(l.DialTimeout, defaultDialTimeout)}
+	conn, err := dialer.DialContext(ctx, network, l.Addr)
+	if err != nil {
+		return nil, smtpErr(PhaseConnect, err)
+	}
+	defer watchContext(ctx, conn)()
+
+	cl, err := newSMTPClient(conn, host, timeoutOrDefault(l.CommandTimeout, defaultCommandTimeout))
+	if err != nil {
+		conn.Close()
+		return nil, smtpErr(PhaseConnect, err)
+	}
+	cl.lmtp = true
+	cl.dataTimeout = timeoutOrDefault(l.DataTimeout, defaultDataTimeout)
+
+	if err := cl.hello(l.localName()); err != nil {
+		cl.close()
+		return nil, smtpErr(PhaseConnect, err)
+	}
+	if l.Auth != nil {
+		if err := cl.authenticate(l.Auth); err != nil {
+			cl.close()
+			return nil, smtpErr(PhaseAuth, err)
+		}
+	}
+	return cl, nil
+}
+
+func (l *LMTPSender) network() string {
+	if l.Network != "" {
+		return l.Network
+	}
+	if strings.Contains(l.Addr, "/") {
+		return "unix"
+	}
+	return "tcp"
+}
+
+func (l *LMTPSender) localName() string {
+	if l.LocalName == "" {
+		return "localhost"
+	}
+	return l.LocalName
+}
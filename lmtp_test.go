@@ -0,0 +1,117 @@
+package pmail_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/KarpelesLab/pmail"
+)
+
+// serveLMTP runs a minimal LMTP server on l, refusing the message for recipients starting
+// with "full@"
+func serveLMTP(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func(c net.Conn) {
+			defer c.Close()
+			r := bufio.NewReader(c)
+			fmt.Fprintf(c, "220 localhost LMTP ready\r\n")
+			var rcpts []string
+			for {
+				ln, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				ln = strings.TrimRight(ln, "\r\n")
+				switch {
+				case strings.HasPrefix(ln, "LHLO "):
+					fmt.Fprintf(c, "250-localhost\r\n250-PIPELINING\r\n250 ENHANCEDSTATUSCODES\r\n")
+				case strings.HasPrefix(ln, "RCPT TO:<"):
+					addr := strings.TrimSuffix(strings.TrimPrefix(ln, "RCPT TO:<"), ">")
+					if strings.HasPrefix(addr, "unknown@") {
+						fmt.Fprintf(c, "550 5.1.1 no such user\r\n")
+						continue
+					}
+					rcpts = append(rcpts, addr)
+					fmt.Fprintf(c, "250 2.1.5 ok\r\n")
+				case ln == "DATA":
+					fmt.Fprintf(c, "354 go ahead\r\n")
+					for {
+						ln, err := r.ReadString('\n')
+						if err != nil {
+							return
+						}
+						if ln == ".\r\n" {
+							break
+						}
+					}
+					for _, addr := range rcpts {
+						if strings.HasPrefix(addr, "full@") {
+							fmt.Fprintf(c, "452 4.2.2 <%s> mailbox full\r\n", addr)
+						} else {
+							fmt.Fprintf(c, "250 2.0.0 <%s> delivered\r\n", addr)
+						}
+					}
+					rcpts = nil
+				case ln == "QUIT":
+					fmt.Fprintf(c, "221 bye\r\n")
+					return
+				default:
+					fmt.Fprintf(c, "250 2.0.0 ok\r\n")
+				}
+			}
+		}(c)
+	}
+}
+
+func TestLMTPSender(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "lmtp.sock")
+	ul, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer ul.Close()
+	go serveLMTP(ul)
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer tl.Close()
+	go serveLMTP(tl)
+
+	for _, addr := range []string{sock, tl.Addr().String()} {
+		s := &pmail.LMTPSender{Addr: addr, PartialDelivery: true}
+		m := testMail()
+		m.Envelope = pmail.NewEnvelope("test@example.com", "bob@example.com", "full@example.com", "unknown@example.com", "carol@example.com")
+		res, err := m.Deliver(context.Background(), s)
+		if err != nil {
+			t.Fatalf("%s: failed to deliver: %s", addr, err)
+		}
+		if len(res.Accepted) != 2 || res.Accepted[0] != "bob@example.com" || res.Accepted[1] != "carol@example.com" {
+			t.Errorf("%s: unexpected accepted recipients %v", addr, res.Accepted)
+		}
+		if len(res.Rejected) != 2 {
+			t.Fatalf("%s: unexpected rejected recipients %+v", addr, res.Rejected)
+		}
+		if e := res.Rejected[0]; e.Recipient != "unknown@example.com" || e.Phase != pmail.PhaseRcpt || !e.Permanent() {
+			t.Errorf("%s: unexpected error %+v", addr, e)
+		}
+		if e := res.Rejected[1]; e.Recipient != "full@example.com" || e.Phase != pmail.PhaseData || e.Code != 452 || e.Enhanced != "4.2.2" {
+			t.Errorf("%s: unexpected error %+v", addr, e)
+		}
+
+		// every recipient refusing the message is an error
+		err = testMail().SendEnvelope(s, pmail.NewEnvelope("test@example.com", "full@example.com"))
+		if err == nil || !strings.Contains(err.Error(), "mailbox full") {
+			t.Errorf("%s: expected error, got %v", addr, err)
+		}
+	}
+}
@@ -20,6 +20,13 @@ type Mail struct {
 	Bcc       []*mail.Address
 	Body      *Part
 	MessageId string
+
+	// Envelope, if set, is used when sending the email instead of the default envelope
+	// built from From, To, Cc and Bcc.
+	Envelope *Envelope
+
+	// DSN, if set, requests delivery status notifications for the default envelope
+	DSN *DSNRequest
 }
 
 func New() *Mail {
@@ -36,12 +43,17 @@ func New() *Mail {
 	return m
 }
 
-// IsValid returns true if the email is valid and can be sent
+// IsValid returns true if the email is valid and can be sent. Recipients are taken from the
+// Envelope if set, or from the To, Cc and Bcc addresses.
 func (m *Mail) IsValid() bool {
 	if m.From == nil {
 		return false
 	}
-	if len(m.To) == 0 {
+	if m.Envelope != nil {
+		if len(m.Envelope.Recipients) == 0 {
+			return false
+		}
+	} else if len(m.Recipients()) == 0 {
 		return false
 	}
 	if m.Body.IsEmpty() {
@@ -68,17 +80,17 @@ func (m *Mail) AddTo(address string, name ...string) {
 
 func (m *Mail) AddCc(address string, name ...string) {
 	if len(name) == 0 {
-		m.Cc = append(m.To, &mail.Address{Address: address})
+		m.Cc = append(m.Cc, &mail.Address{Address: address})
 	} else {
-		m.Cc = append(m.To, &mail.Address{Address: address, Name: strings.Join(name, " ")})
+		m.Cc = append(m.Cc, &mail.Address{Address: address, Name: strings.Join(name, " ")})
 	}
 }
 
 func (m *Mail) AddBcc(address string, name ...string) {
 	if len(name) == 0 {
-		m.Bcc = append(m.To, &mail.Address{Address: address})
+		m.Bcc = append(m.Bcc, &mail.Address{Address: address})
 	} else {
-		m.Bcc = append(m.To, &mail.Address{Address: address, Name: strings.Join(name, " ")})
+		m.Bcc = append(m.Bcc, &mail.Address{Address: address, Name: strings.Join(name, " ")})
 	}
 }
 
@@ -105,6 +117,11 @@ func (m *Mail) SetBodyHelper(data []byte, typ string) error {
 		data = fixcrlf(data)
 	}
 
+	if rel := p.FindType(Related, false); rel != nil && typ == TypeHTML {
+		// html body is the root of the related part containing inline images
+		p = rel
+	}
+
 	c := p.FindType(typ, false)
 	if c != nil {
 		// already have a part of this type, just replace the body
@@ -117,7 +134,12 @@ func (m *Mail) SetBodyHelper(data []byte, typ string) error {
 	c = NewPart(typ)
 	c.Data = io.NopCloser(bytes.NewReader(data))
 	c.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(data)), nil }
-	p.Append(c)
+	if typ == TypeText || p.Type == Related {
+		// text/plain goes first in alternative parts, and html first in related parts
+		p.Children = append([]*Part{c}, p.Children...)
+	} else {
+		p.Append(c)
+	}
 
 	return nil
 }
@@ -128,12 +150,56 @@ func (m *Mail) SetDate(t time.Time) {
 	m.Body.Headers.Set("Date", t.Format(time.RFC1123))
 }
 
+// WriteTo writes the email to w. The Bcc header is never included in the output.
 func (m *Mail) WriteTo(w io.Writer) (int64, error) {
+	return m.writeTo(w, false, false)
+}
+
+// writeTo7Bit writes the email with its 8bit parts converted as done by Convert7Bit, without
+// modifying it
+func (m *Mail) writeTo7Bit(w io.Writer) (int64, error) {
+	return m.writeTo(w, false, true)
+}
+
+func (m *Mail) writeTo(w io.Writer, withBcc, to7Bit bool) (int64, error) {
 	m.SetTargetHeaders()
 
+	if withBcc && len(m.Bcc) > 0 {
+		m.Body.Headers.SetAddressList("Bcc", m.Bcc)
+		defer m.Body.Headers.Del("Bcc")
+	}
+
+	if to7Bit {
+		return m.Body.copy7Bit().WriteTo(w)
+	}
 	return m.Body.WriteTo(w)
 }
 
+// Convert7Bit converts the 8bit parts of the email to quoted-printable or base64, see
+// Part.Convert7Bit. This is done automatically when sending to servers without 8BITMIME.
+func (m *Mail) Convert7Bit() {
+	m.Body.Convert7Bit()
+}
+
+// Recipients returns the list of addresses the email should be delivered to, including
+// Cc and Bcc recipients, without duplicates.
+func (m *Mail) Recipients() []string {
+	res := make([]string, 0, len(m.To)+len(m.Cc)+len(m.Bcc))
+	seen := make(map[string]bool)
+
+	for _, list := range [][]*mail.Address{m.To, m.Cc, m.Bcc} {
+		for _, a := range list {
+			k := strings.ToLower(a.Address)
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			res = append(res, a.Address)
+		}
+	}
+	return res
+}
+
 // SetTargetHeaders sets the various headers needed for sending the mail based on the values present in Mail
 // This is called automatically when the email is sent and typically doesn't need to be manually called
 func (m *Mail) SetTargetHeaders() {
@@ -155,27 +221,34 @@ func (m *Mail) SetTargetHeaders() {
 	} else {
 		m.Body.Headers.Del("Cc")
 	}
-	if len(m.Bcc) > 0 {
-		m.Body.Headers.SetAddressList("Bcc", m.Bcc) // we set Bcc because some email sending methods (such as sendmail) will require it
-	} else {
-		m.Body.Headers.Del("Bcc")
-	}
+	// Bcc is only part of the envelope, see RecipientsFromHeaders for senders requiring it
+	m.Body.Headers.Del("Bcc")
+
+	m.Body.Headers.Set("Message-Id", "<"+m.messageId()+">")
+}
 
+// messageId returns the Message-Id of the email, generating it if needed
+func (m *Mail) messageId() string {
 	if m.MessageId == "" {
-		// generate messageId (from from?)
-		host := "localhost"
-		if m.From != nil {
-			pos := strings.LastIndexByte(m.From.Address, '@')
-			if pos != -1 {
-				host = m.From.Address[pos+1:]
-			}
+		m.MessageId = rndpass.Code(32, rndpass.RangeFull) + "@" + m.host()
+	}
+	return m.MessageId
+}
+
+// host returns the host name to use when generating identifiers for this email, based on
+// the From address if possible
+func (m *Mail) host() string {
+	host := "localhost"
+	if m.From != nil {
+		pos := strings.LastIndexByte(m.From.Address, '@')
+		if pos != -1 {
+			host = m.From.Address[pos+1:]
 		}
-		if host == "localhost" {
-			if h, err := os.Hostname(); err == nil {
-				host = h
-			}
+	}
+	if host == "localhost" {
+		if h, err := os.Hostname(); err == nil {
+			host = h
 		}
-		m.MessageId = rndpass.Code(32, rndpass.RangeFull) + "@" + host
 	}
-	m.Body.Headers.Set("Message-Id", "<"+m.MessageId+">")
+	return host
 }
@@ -2,7 +2,11 @@ package pmail_test
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"net/mail"
+	"strings"
 	"testing"
 	"time"
 
@@ -99,3 +103,112 @@ Content-Type: text/html
 
 	//log.Printf("Email:\n%s", buf.Bytes())
 }
+
+func TestEncodedHeaders(t *testing.T) {
+	m := pmail.New()
+	m.SetFrom("test@example.com", "Test")
+	m.SetDate(time.Unix(1687756384, 0).UTC())
+	m.MessageId = "test4@localhost"
+	m.AddTo("taro@example.jp", "山田 太郎")
+	m.AddTo("hans@example.com", "Müller, Hans")
+	m.SetSubject("Réunion du 26 juin, café offert")
+	m.Body.Headers.Set("X-Comment", "日本語のテキスト")
+	// headers with an unknown syntax are never encoded
+	m.Body.Headers.Set("List-Unsubscribe", "<mailto:désabonner@example.fr?subject==?unsubscribe?=>")
+	m.SetBodyText("Hello")
+
+	buf := &bytes.Buffer{}
+	m.WriteTo(buf)
+
+	expect := []string{
+		"From: \"Test\" <test@example.com>\r\n",
+		"List-Unsubscribe: <mailto:désabonner@example.fr?subject==?unsubscribe?=>\r\n",
+		"Subject: =?utf-8?q?R=C3=A9union?= du 26 juin, =?utf-8?b?Y2Fmw6k=?= offert\r\n",
+		"To: =?utf-8?b?5bGx55SwIOWkqumDjg==?= <taro@example.jp>,\r\n =?utf-8?q?M=C3=BCller=2C_Hans?= <hans@example.com>\r\n",
+		"X-Comment: =?utf-8?b?5pel5pys6Kqe44Gu44OG44Kt44K544OI?=\r\n",
+	}
+	for _, e := range expect {
+		if !bytes.Contains(buf.Bytes(), []byte(e)) {
+			t.Errorf("header %q not found in output:\n%s", e, buf.Bytes())
+		}
+	}
+
+	// parsing should give back the original values
+	m2, err := pmail.Parse(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to parse mail: %s", err)
+	}
+	if s := m2.Body.Headers.Get("Subject"); s != "Réunion du 26 juin, café offert" {
+		t.Errorf("unexpected subject %q", s)
+	}
+	if len(m2.To) != 2 || m2.To[0].Name != "山田 太郎" || m2.To[1].Name != "Müller, Hans" {
+		t.Errorf("unexpected To: %v", m2.To)
+	}
+}
+
+func TestFoldedHeaders(t *testing.T) {
+	m := pmail.New()
+	m.SetFrom("test@example.com", "Test")
+	m.MessageId = "test5@localhost"
+	for i := 0; i < 200; i++ {
+		m.AddTo(fmt.Sprintf("user%d@example.com", i), fmt.Sprintf("User %d", i))
+	}
+	m.SetSubject(strings.Repeat("This is a very long subject ", 10) + strings.TrimSpace(strings.Repeat("très ", 30)))
+	refs := ""
+	for i := 0; i < 50; i++ {
+		refs += fmt.Sprintf("<ref%d@example.com>", i)
+	}
+	m.Body.Headers.Set("References", refs)
+	m.SetBodyText("Hello")
+
+	buf := &bytes.Buffer{}
+	m.WriteTo(buf)
+
+	hdr, _, _ := bytes.Cut(buf.Bytes(), []byte("\r\n\r\n"))
+	for _, ln := range bytes.Split(hdr, []byte("\r\n")) {
+		if len(ln) > 78 {
+			t.Errorf("header line too long (%d): %s", len(ln), ln)
+		}
+	}
+
+	m2, err := pmail.Parse(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to parse mail: %s", err)
+	}
+	if len(m2.To) != 200 || m2.To[199].Address != "user199@example.com" {
+		t.Errorf("unexpected To after folding: %d recipients", len(m2.To))
+	}
+	if s := m2.Body.Headers.Get("Subject"); s != m.Body.Headers.Get("Subject") {
+		t.Errorf("unexpected subject after folding: %q", s)
+	}
+	if s := strings.ReplaceAll(m2.Body.Headers.Get("References"), " ", ""); s != refs {
+		t.Errorf("unexpected references after folding: %q", s)
+	}
+
+	// words longer than the line limit are encoded to be folded in unstructured headers
+	long := "https://example.com/" + strings.Repeat("a", 1200)
+	m.SetSubject("See " + long + " here")
+	buf.Reset()
+	if _, err := m.WriteTo(buf); err != nil {
+		t.Fatalf("failed to write mail: %s", err)
+	}
+	hdr, _, _ = bytes.Cut(buf.Bytes(), []byte("\r\n\r\n"))
+	for _, ln := range bytes.Split(hdr, []byte("\r\n")) {
+		if len(ln) > 998 {
+			t.Errorf("header line too long (%d)", len(ln))
+		}
+	}
+	m2, err = pmail.Parse(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to parse mail: %s", err)
+	}
+	if s := m2.Body.Headers.Get("Subject"); s != "See "+long+" here" {
+		t.Errorf("unexpected subject after folding: %q", s)
+	}
+
+	// structured headers cannot be changed, writing them fails
+	m.Body.Headers.Set("References", "<"+long+"@example.com>")
+	if _, err := m.WriteTo(io.Discard); !errors.Is(err, pmail.ErrHeaderTooLong) {
+		t.Errorf("expected an error for a too long message id, got %v", err)
+	}
+}
@@ -0,0 +1,297 @@
+package pmail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// MultiStrategy selects the order in which MultiSender tries its backends
+type MultiStrategy int
+
+const (
+	Failover   MultiStrategy = iota // always try backends in order
+	RoundRobin                      // start with the next backend for each message
+	Weighted                        // start with a backend chosen randomly according to weights
+)
+
+// Backend is a sender used by MultiSender
+type Backend struct {
+	Name   string // reported to OnSend and by SendVia, defaults to "backend<n>"
+	Sender Sender
+	Weight int // relative share of messages with the Weighted strategy, defaults to 1
+
+	failures  int       // consecutive temporary failures
+	downUntil time.Time // backend is skipped until then
+}
+
+// MultiSender sends emails through several backends. If a backend fails with a temporary error,
+// the next one is tried, while permanent errors (5xx) are returned immediately. With backends
+// implementing ResultSender, only the recipients temporarily rejected are sent to the next one.
+// Backends failing MaxFailures times in a row are skipped for Cooldown, unless no other backend
+// is available. It is safe for concurrent use.
+type MultiSender struct {
+	Backends    []*Backend
+	Strategy    MultiStrategy
+	MaxFailures int           // consecutive failures before a backend is skipped, defaults to 3
+	Cooldown    time.Duration // how long failing backends are skipped, defaults to 1 minute
+
+	// OnSend, if set, is called after each attempt with the backend used and its result
+	OnSend func(backend string, env *Envelope, err error)
+
+	mu   sync.Mutex
+	next int // round robin position
+}
+
+const (
+	defaultMaxFailures = 3
+	defaultCooldown    = time.Minute
+)
+
+// NewMultiSender returns a MultiSender trying the given senders in order
+func NewMultiSender(senders ...Sender) *MultiSender {
+	m := &MultiSender{}
+	for _, s := range senders {
+		m.Backends = append(m.Backends, &Backend{Sender: s})
+	}
+	return m
+}
+
+// Send sends the email through the first available backend
+func (m *MultiSender) Send(from string, to []string, msg io.WriterTo) error {
+	return m.SendContext(context.Background(), NewEnvelope(from, to...), msg)
+}
+
+// SendEnvelope sends the email through the first available backend using the given envelope
+func (m *MultiSender) SendEnvelope(env *Envelope, msg io.WriterTo) error {
+	return m.SendContext(context.Background(), env, msg)
+}
+
+// SendContext sends the email through the first available backend using the given envelope
+func (m *MultiSender) SendContext(ctx context.Context, env *Envelope, msg io.WriterTo) error {
+	_, res, err := m.deliver(ctx, env, msg)
+	if err != nil {
+		return err
+	}
+	return res.Err()
+}
+
+// Deliver sends the email and returns the result for each recipient. Recipients temporarily
+// rejected by a backend able to report per-recipient results are tried on the next backend.
+// An error is returned only if no recipient accepted the email.
+func (m *MultiSender) Deliver(ctx context.Context, env *Envelope, msg io.WriterTo) (*SendResult, error) {
+	_, res, err := m.deliver(ctx, env, msg)
+	return res, err
+}
+
+// SendVia sends the email and returns the addresses accepted by each backend, by backend
+// name. Recipients may be split across several backends when some of them are temporarily
+// rejected.
+func (m *MultiSender) SendVia(ctx context.Context, env *Envelope, msg io.WriterTo) (map[string][]string, error) {
+	via, res, err := m.deliver(ctx, env, msg)
+	if err != nil {
+		return via, err
+	}
+	return via, res.Err()
+}
+
+func (m *MultiSender) deliver(ctx context.Context, env *Envelope, msg io.WriterTo) (map[string][]string, *SendResult, error) {
+	order := m.order()
+	if len(order) == 0 {
+		return nil, nil, errors.New("cannot send email: no backend configured")
+	}
+
+	// messages other than Mail may only be readable once, keep a copy to send them again
+	if _, ok := msg.(writer7Bit); !ok && len(order) > 1 {
+		buf := &bytes.Buffer{}
+		if _, err := msg.WriteTo(buf); err != nil {
+			return nil, nil, err
+		}
+		msg = &replayWriter{buf.Bytes()}
+	}
+
+	res := &SendResult{}
+	via := make(map[string][]string)
+	var err error
+	var retry []*SMTPError // temporary rejections of the last backend
+	for _, n := range order {
+		b := m.Backends[n]
+		name := b.name(n)
+
+		var r *SendResult
+		if rs, ok := b.Sender.(ResultSender); ok {
+			r, err = rs.Deliver(ctx, env, msg)
+		} else {
+			err = sendContext(ctx, b.Sender, env, msg)
+		}
+		if m.OnSend != nil {
+			if err == nil && r != nil {
+				m.OnSend(name, env, r.Err())
+			} else {
+				m.OnSend(name, env, err)
+			}
+		}
+		if ctx.Err() != nil {
+			return via, res, ctx.Err()
+		}
+
+		// rejected recipients do not mean the backend is failing
+		m.record(b, err == nil || isPermanent(err) || hasReplies(r))
+		if r == nil || (err != nil && !hasReplies(r)) {
+			if err == nil {
+				res.Accepted = append(res.Accepted, env.Addresses()...)
+				via[name] = append(via[name], env.Addresses()...)
+				return via, res, nil
+			}
+			if isPermanent(err) {
+				break
+			}
+			// the whole message failed, try all recipients on the next backend
+			retry = nil
+			continue
+		}
+
+		if len(r.Accepted) > 0 {
+			res.Accepted = append(res.Accepted, r.Accepted...)
+			via[name] = append(via[name], r.Accepted...)
+		}
+		retry = nil
+		for _, e := range r.Rejected {
+			if e.Temporary() {
+				retry = append(retry, e)
+			} else {
+				res.Rejected = append(res.Rejected, e)
+			}
+		}
+		err = nil
+		if len(retry) == 0 {
+			break
+		}
+		// only send to the temporarily rejected recipients on the next backend
+		next := *env
+		next.Recipients = nil
+		for _, rcpt := range env.Recipients {
+			for _, e := range retry {
+				if e.Recipient == rcpt.Address {
+					next.Recipients = append(next.Recipients, rcpt)
+					break
+				}
+			}
+		}
+		env = &next
+	}
+
+	res.Rejected = append(res.Rejected, retry...)
+	if err != nil {
+		// the last backend failed for all remaining recipients
+		for _, rcpt := range env.Recipients {
+			e := *smtpErr(PhaseConnect, err)
+			e.Recipient = rcpt.Address
+			res.Rejected = append(res.Rejected, &e)
+		}
+	}
+	if len(res.Accepted) == 0 {
+		if err != nil {
+			return via, res, err
+		}
+		return via, res, res.Err()
+	}
+	return via, res, nil
+}
+
+// order returns the indexes of the backends in the order they should be tried: available
+// backends first according to Strategy, then the ones in cooldown as a last resort
+func (m *MultiSender) order() []int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := len(m.Backends)
+	if n == 0 {
+		return nil
+	}
+	first := 0
+	switch m.Strategy {
+	case RoundRobin:
+		first = m.next % n
+		m.next++
+	case Weighted:
+		total := 0
+		for _, b := range m.Backends {
+			total += b.weight()
+		}
+		r := rand.Intn(total)
+		for i, b := range m.Backends {
+			if r -= b.weight(); r < 0 {
+				first = i
+				break
+			}
+		}
+	}
+
+	now := time.Now()
+	var up, down []int
+	for i := 0; i < n; i++ {
+		idx := (first + i) % n
+		if m.Strategy == Weighted && i > 0 {
+			// remaining backends are tried in priority order
+			idx = i - 1
+			if idx >= first {
+				idx++
+			}
+		}
+		if now.Before(m.Backends[idx].downUntil) {
+			down = append(down, idx)
+		} else {
+			up = append(up, idx)
+		}
+	}
+	return append(up, down...)
+}
+
+// record updates the health of the backend after an attempt
+func (m *MultiSender) record(b *Backend, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ok {
+		b.failures = 0
+		b.downUntil = time.Time{}
+		return
+	}
+	b.failures++
+	max := m.MaxFailures
+	if max <= 0 {
+		max = defaultMaxFailures
+	}
+	if b.failures >= max {
+		b.downUntil = time.Now().Add(timeoutOrDefault(m.Cooldown, defaultCooldown))
+	}
+}
+
+func (b *Backend) name(n int) string {
+	if b.Name != "" {
+		return b.Name
+	}
+	return fmt.Sprintf("backend%d", n)
+}
+
+func (b *Backend) weight() int {
+	if b.Weight <= 0 {
+		return 1
+	}
+	return b.Weight
+}
+
+// replayWriter writes the same data each time WriteTo is called
+type replayWriter struct {
+	data []byte
+}
+
+func (r *replayWriter) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(r.data)
+	return int64(n), err
+}
@@ -0,0 +1,110 @@
+package pmail_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/pmail"
+	"github.com/KarpelesLab/pmail/pmailtest"
+)
+
+func TestMultiSenderFailover(t *testing.T) {
+	temp := &pmail.SMTPError{Phase: pmail.PhaseConnect, Code: 421, Message: "service not available"}
+	a, b := &pmailtest.Recorder{Err: temp}, &pmailtest.Recorder{}
+	ms := &pmail.MultiSender{
+		Backends:    []*pmail.Backend{{Name: "a", Sender: a}, {Name: "b", Sender: b}},
+		MaxFailures: 2,
+		Cooldown:    time.Hour,
+	}
+	var tried []string
+	ms.OnSend = func(backend string, env *pmail.Envelope, err error) { tried = append(tried, backend) }
+
+	// data that can only be read once must be sent again to the next backend
+	for i := 0; i < 3; i++ {
+		via, err := ms.SendVia(context.Background(), pmail.NewEnvelope("test@example.com", "bob@example.com"), bytes.NewReader([]byte("Subject: test\r\n\r\nHello\r\n")))
+		if err != nil || len(via) != 1 || len(via["b"]) != 1 {
+			t.Fatalf("expected delivery through b, got %v %v", via, err)
+		}
+	}
+	// a is skipped after two failures
+	if expect := "a b a b b"; strings.Join(tried, " ") != expect {
+		t.Errorf("unexpected attempts %q, expected %q", strings.Join(tried, " "), expect)
+	}
+	if msgs := b.Messages(); len(msgs) != 3 || string(msgs[2].Data) != "Subject: test\r\n\r\nHello\r\n" {
+		t.Errorf("unexpected messages %+v", msgs)
+	}
+
+	// permanent errors are not retried on other backends
+	tried = nil
+	b.Err = &pmail.SMTPError{Phase: pmail.PhaseRcpt, Code: 550, Message: "no such user"}
+	err := testMail().Send(ms)
+	var se *pmail.SMTPError
+	if !errors.As(err, &se) || se.Code != 550 || strings.Join(tried, " ") != "b" {
+		t.Errorf("unexpected result %v after %q", err, strings.Join(tried, " "))
+	}
+}
+
+func TestMultiSenderRecipients(t *testing.T) {
+	a, b := pmailtest.NewServer(), pmailtest.NewServer()
+	defer a.Close()
+	defer b.Close()
+	a.FailRcpt("carol@example.com", &pmail.SMTPError{Code: 450, Enhanced: "4.2.1", Message: "Try again later"})
+	a.FailRcpt("dave@example.com", &pmail.SMTPError{Code: 550, Enhanced: "5.1.1", Message: "No such user"})
+	sa := a.Sender()
+	sa.PartialDelivery = true
+	ms := &pmail.MultiSender{Backends: []*pmail.Backend{{Name: "a", Sender: sa}, {Name: "b", Sender: b.Sender()}}}
+
+	m := testMail()
+	m.AddCc("carol@example.com")
+	m.AddCc("dave@example.com")
+	res, err := m.Deliver(context.Background(), ms)
+	if err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	if len(res.Accepted) != 2 || len(res.Rejected) != 1 || res.Rejected[0].Recipient != "dave@example.com" || !res.Rejected[0].Permanent() {
+		t.Errorf("unexpected result: %+v", res)
+	}
+	// only the temporarily rejected recipient is sent to the next backend
+	if msgs := b.Messages(); len(msgs) != 1 || len(msgs[0].Envelope.Recipients) != 1 || msgs[0].Envelope.Recipients[0].Address != "carol@example.com" {
+		t.Errorf("unexpected messages on b: %+v", msgs)
+	}
+	if msgs := a.Messages(); len(msgs) != 1 || len(msgs[0].Envelope.Recipients) != 1 {
+		t.Errorf("unexpected messages on a: %+v", msgs)
+	}
+
+	// SendVia reports the backend used for each recipient
+	via, err := ms.SendVia(context.Background(), pmail.NewEnvelope("test@example.com", "bob@example.com", "carol@example.com"), m)
+	if expect := map[string][]string{"a": {"bob@example.com"}, "b": {"carol@example.com"}}; err != nil || !reflect.DeepEqual(via, expect) {
+		t.Errorf("unexpected backends %v, %v", via, err)
+	}
+}
+
+func TestMultiSenderRoundRobin(t *testing.T) {
+	a, b := &pmailtest.Recorder{}, &pmailtest.Recorder{}
+	ms := pmail.NewMultiSender(a, b)
+	ms.Strategy = pmail.RoundRobin
+	for i := 0; i < 4; i++ {
+		if err := testMail().Send(ms); err != nil {
+			t.Fatalf("failed to send: %s", err)
+		}
+	}
+	if len(a.Messages()) != 2 || len(b.Messages()) != 2 {
+		t.Errorf("unexpected distribution %d/%d", len(a.Messages()), len(b.Messages()))
+	}
+
+	a.Reset()
+	b.Reset()
+	ms.Strategy = pmail.Weighted
+	ms.Backends[0].Weight = 3
+	for i := 0; i < 400; i++ {
+		testMail().Send(ms)
+	}
+	if len(a.Messages()) < 250 || len(b.Messages()) < 50 {
+		t.Errorf("unexpected distribution %d/%d", len(a.Messages()), len(b.Messages()))
+	}
+}
@@ -0,0 +1,263 @@
+package pmail
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// Parse reads a RFC 5322 message from r and returns the matching Mail object,
+// with its Body part tree and address fields filled.
+func Parse(r io.Reader) (*Mail, error) {
+	br := bufio.NewReader(r)
+	hdrs, err := readHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	// split content headers (which belong to the content part) from the message headers
+	m := &Mail{Body: &Part{Type: TypeEmail, Headers: make(Header)}}
+	content := make(Header)
+	for k, v := range hdrs {
+		if strings.HasPrefix(k, "Content-") {
+			content[k] = v
+		} else {
+			m.Body.Headers[k] = v
+		}
+	}
+
+	c, err := readPart(content, br, "")
+	if err != nil {
+		return nil, err
+	}
+	m.Body.Append(c)
+
+	if err := m.loadTargetHeaders(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReadPart reads a single MIME entity (headers and body) from r. Multipart
+// entities are read recursively, and the content of leaf parts is decoded.
+func ReadPart(r io.Reader) (*Part, error) {
+	br := bufio.NewReader(r)
+	hdrs, err := readHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	return readPart(hdrs, br, "")
+}
+
+// loadTargetHeaders is the reverse of SetTargetHeaders
+func (m *Mail) loadTargetHeaders() error {
+	h := m.Body.Headers
+
+	from, err := parseAddressHeader(h, "From")
+	if err != nil {
+		return err
+	}
+	if len(from) > 0 {
+		m.From = from[0]
+	}
+	if m.ReplyTo, err = parseAddressHeader(h, "Reply-To"); err != nil {
+		return err
+	}
+	if m.To, err = parseAddressHeader(h, "To"); err != nil {
+		return err
+	}
+	if m.Cc, err = parseAddressHeader(h, "Cc"); err != nil {
+		return err
+	}
+	if m.Bcc, err = parseAddressHeader(h, "Bcc"); err != nil {
+		return err
+	}
+
+	m.MessageId = strings.Trim(strings.TrimSpace(h.Get("Message-Id")), "<>")
+	return nil
+}
+
+func parseAddressHeader(h Header, key string) ([]*mail.Address, error) {
+	res, err := h.AddressList(key)
+	switch err {
+	case nil:
+		return res, nil
+	case mail.ErrHeaderNotPresent:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("invalid %s header: %w", key, err)
+	}
+}
+
+func readHeader(br *bufio.Reader) (Header, error) {
+	hdrs, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err == io.EOF {
+		if len(hdrs) == 0 {
+			return nil, ErrInvalidEmail
+		}
+		// headers without body
+	} else if err != nil {
+		return nil, err
+	}
+	decodeHeader(Header(hdrs))
+	return Header(hdrs), nil
+}
+
+// decodeHeader decodes RFC 2047 encoded-words found in unstructured headers, so
+// values are stored as UTF-8 text and encoded again by Header.Encode
+func decodeHeader(h Header) {
+	dec := &mime.WordDecoder{}
+	for k, v := range h {
+		if !isUnstructured(k) {
+			continue
+		}
+		for n, s := range v {
+			if d, err := dec.DecodeHeader(s); err == nil {
+				v[n] = d
+			}
+		}
+	}
+}
+
+// readPart builds a part from its headers and body. defType is the type to
+// use if no Content-Type is specified (empty means text/plain).
+func readPart(hdrs Header, body io.Reader, defType string) (*Part, error) {
+	p := &Part{Headers: hdrs}
+
+	typ, params, err := mime.ParseMediaType(hdrs.Get("Content-Type"))
+	if err != nil {
+		// RFC 2045 5.2: default to text/plain (or the multipart default)
+		typ = defType
+		if typ == "" {
+			typ = TypeText
+		}
+	}
+	p.Type = typ
+
+	if p.IsMultipart() {
+		p.Boundary = params["boundary"]
+		if p.Boundary == "" {
+			return nil, ErrMissingBoundary
+		}
+		if typ == "multipart/signed" {
+			return p, readSignedParts(p, body)
+		}
+		childType := ""
+		if typ == "multipart/digest" {
+			childType = TypeEmail
+		}
+
+		mr := multipart.NewReader(body, p.Boundary)
+		for {
+			sub, err := mr.NextRawPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			c, err := readPart(Header(sub.Header), sub, childType)
+			if err != nil {
+				return nil, err
+			}
+			p.Append(c)
+		}
+		return p, nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(hdrs.Get("Content-Transfer-Encoding"))) {
+	case "quoted-printable":
+		p.Encoding = 'q'
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		p.Encoding = 'b'
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(typ, "text/") && p.Encoding != 'b' {
+		// base64 content is kept as is, other encodings are line based
+		data = fixcrlf(data)
+	}
+	p.Data = io.NopCloser(bytes.NewReader(data))
+	p.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(data)), nil }
+
+	return p, nil
+}
+
+// readSignedParts reads the children of a multipart/signed part, keeping their raw content so
+// the signature can be verified and the message written again without altering it
+func readSignedParts(p *Part, body io.Reader) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	for _, raw := range splitMultipart(data, p.Boundary) {
+		br := bufio.NewReader(bytes.NewReader(raw))
+		hdrs, err := textproto.NewReader(br).ReadMIMEHeader()
+		if err != nil && err != io.EOF {
+			return err
+		}
+		c, err := readPart(Header(hdrs), br, "")
+		if err != nil {
+			return err
+		}
+		c.raw = raw
+		p.Append(c)
+	}
+	return nil
+}
+
+// splitMultipart returns the raw entities found in a multipart body (RFC 2046 5.1.1)
+func splitMultipart(data []byte, boundary string) [][]byte {
+	delim := []byte("--" + boundary)
+	var res [][]byte
+	start := -1
+	pos := 0
+	for {
+		idx := bytes.Index(data[pos:], delim)
+		if idx == -1 {
+			return res
+		}
+		idx += pos
+		if idx > 0 && data[idx-1] != '\n' {
+			// not at the start of a line
+			pos = idx + len(delim)
+			continue
+		}
+		if start != -1 {
+			// the line break before the delimiter is part of it
+			end := idx
+			if end > start && data[end-1] == '\n' {
+				end--
+			}
+			if end > start && data[end-1] == '\r' {
+				end--
+			}
+			res = append(res, data[start:end])
+		}
+
+		rest := data[idx+len(delim):]
+		if bytes.HasPrefix(rest, []byte("--")) {
+			// close delimiter
+			return res
+		}
+		nl := bytes.IndexByte(rest, '\n')
+		if nl == -1 {
+			return res
+		}
+		start = idx + len(delim) + nl + 1
+		pos = start
+	}
+}
@@ -0,0 +1,138 @@
+package pmail_test
+
+import (
+	"bytes"
+	"io"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/pmail"
+)
+
+func TestParseRoundTrip(t *testing.T) {
+	m := pmail.New()
+	m.SetFrom("test@example.com", "Test")
+	m.SetDate(time.Unix(1687756384, 0).UTC())
+	m.MessageId = "test3@localhost"
+	m.AddTo("bob@example.com", "Bob Test")
+	m.Cc = []*mail.Address{{Address: "alice@example.com"}}
+	m.SetSubject("Hello Bob")
+	m.SetBodyText("Hello Bob,\r\n\r\nCan you look at this? Ça coûte 10€.")
+	m.SetBodyHtml("<p>Hello Bob,</p>\r\n<p>Can you look at this?</p>")
+
+	buf := &bytes.Buffer{}
+	if _, err := m.WriteTo(buf); err != nil {
+		t.Fatalf("failed to write mail: %s", err)
+	}
+	orig := buf.Bytes()
+
+	m2, err := pmail.Parse(bytes.NewReader(orig))
+	if err != nil {
+		t.Fatalf("failed to parse mail: %s", err)
+	}
+
+	if m2.From == nil || m2.From.Address != "test@example.com" || m2.From.Name != "Test" {
+		t.Errorf("unexpected From: %v", m2.From)
+	}
+	if len(m2.To) != 1 || m2.To[0].Address != "bob@example.com" {
+		t.Errorf("unexpected To: %v", m2.To)
+	}
+	if len(m2.Cc) != 1 || m2.Cc[0].Address != "alice@example.com" {
+		t.Errorf("unexpected Cc: %v", m2.Cc)
+	}
+	if m2.MessageId != "test3@localhost" {
+		t.Errorf("unexpected MessageId: %s", m2.MessageId)
+	}
+
+	txt := m2.Body.FindType(pmail.TypeText, true)
+	if txt == nil {
+		t.Fatalf("text part not found")
+	}
+	if txt.Encoding != 'q' {
+		t.Errorf("unexpected text encoding %q", txt.Encoding)
+	}
+	r, _ := txt.GetBody()
+	data, _ := io.ReadAll(r)
+	if string(data) != "Hello Bob,\r\n\r\nCan you look at this? Ça coûte 10€." {
+		t.Errorf("unexpected text body: %q", data)
+	}
+
+	// writing the parsed mail should produce the same output
+	buf2 := &bytes.Buffer{}
+	if _, err := m2.WriteTo(buf2); err != nil {
+		t.Fatalf("failed to write parsed mail: %s", err)
+	}
+	if !bytes.Equal(orig, buf2.Bytes()) {
+		t.Errorf("parsed mail not as expected.\nexpected:\n%s\noutput:\n%s", orig, buf2.Bytes())
+	}
+}
+
+func TestParseNested(t *testing.T) {
+	msg := `From: Test <test@example.com>
+To: bob@example.com
+Subject: Nested
+Message-Id: <nested@localhost>
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="outer"
+
+preamble
+--outer
+Content-Type: multipart/alternative; boundary=inner
+
+--inner
+Content-Type: text/plain; charset=utf-8
+
+plain text
+--inner
+Content-Type: text/html; charset=utf-8
+Content-Transfer-Encoding: quoted-printable
+
+<p>html =3D text</p>
+--inner--
+
+--outer
+Content-Type: application/octet-stream
+Content-Transfer-Encoding: base64
+
+aGVsbG8gd29y
+bGQ=
+--outer--
+`
+
+	m, err := pmail.Parse(strings.NewReader(msg))
+	if err != nil {
+		t.Fatalf("failed to parse mail: %s", err)
+	}
+
+	mixed := m.Body.FindType(pmail.Mixed, false)
+	if mixed == nil || mixed.Boundary != "outer" || len(mixed.Children) != 2 {
+		t.Fatalf("unexpected mixed part: %+v", mixed)
+	}
+	alt := mixed.FindType(pmail.Alternative, false)
+	if alt == nil || alt.Boundary != "inner" || len(alt.Children) != 2 {
+		t.Fatalf("unexpected alternative part: %+v", alt)
+	}
+
+	expect := map[string]string{
+		pmail.TypeText:             "plain text",
+		pmail.TypeHTML:             "<p>html = text</p>",
+		"application/octet-stream": "hello world",
+	}
+	for typ, body := range expect {
+		p := m.Body.FindType(typ, true)
+		if p == nil {
+			t.Errorf("part %s not found", typ)
+			continue
+		}
+		r, _ := p.GetBody()
+		data, _ := io.ReadAll(r)
+		if string(data) != body {
+			t.Errorf("unexpected %s body: %q", typ, data)
+		}
+	}
+	if m.Body.Headers.Get("Subject") != "Nested" {
+		t.Errorf("unexpected subject %q", m.Body.Headers.Get("Subject"))
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
+	"mime"
 	"mime/quotedprintable"
 	"strings"
 
@@ -18,6 +19,8 @@ type Part struct {
 	Headers  Header
 	Boundary string
 	Encoding byte
+
+	raw []byte // complete entity written as is, used for signed content that must not change
 }
 
 func NewPart(typ string) *Part {
@@ -64,7 +67,7 @@ func (p *Part) IsEmpty() bool {
 	if p.Data == nil && p.GetBody != nil {
 		p.Data, _ = p.GetBody()
 	}
-	return len(p.Children) == 0 && p.Data == nil
+	return len(p.Children) == 0 && p.Data == nil && p.raw == nil
 }
 
 func (p *Part) Append(c *Part) {
@@ -73,6 +76,11 @@ func (p *Part) Append(c *Part) {
 
 // WriteTo writes the part to the given output
 func (p *Part) WriteTo(w io.Writer) (int64, error) {
+	if p.raw != nil {
+		n, err := w.Write(p.raw)
+		return int64(n), err
+	}
+
 	wc := &writeCounter{W: w}
 	w = wc
 
@@ -87,11 +95,15 @@ func (p *Part) WriteTo(w io.Writer) (int64, error) {
 
 	if len(p.Children) > 0 {
 		// enforce content type & boundary
-		hdrs.Set("Content-Type", p.Type+"; boundary="+p.Boundary)
+		hdrs.Set("Content-Type", p.multipartType())
 	}
 
 	// Write headers
-	w.Write(hdrs.Encode())
+	hdr, err := hdrs.Encode()
+	if err != nil {
+		return wc.C, err
+	}
+	w.Write(hdr)
 	w.Write([]byte{'\r', '\n'})
 
 	isMultipart := strings.HasPrefix(hdrs.Get("Content-Type"), "multipart/")
@@ -128,6 +140,10 @@ func (p *Part) WriteTo(w io.Writer) (int64, error) {
 
 	// for each children...
 	for _, child := range p.Children {
+		if child.IsMultipart() && len(child.Children) == 0 && child.raw == nil {
+			// skip empty containers, such as an alternative part without body
+			continue
+		}
 		// boundary start
 		fmt.Fprintf(w, "\r\n--%s\r\n", p.Boundary)
 		_, err := child.WriteTo(w)
@@ -141,6 +157,78 @@ func (p *Part) WriteTo(w io.Writer) (int64, error) {
 	return wc.C, nil
 }
 
+// Uses8Bit returns true if the part or any of its children uses the 8bit or binary transfer
+// encoding, which requires the 8BITMIME extension when sending through SMTP
+func (p *Part) Uses8Bit() bool {
+	switch strings.ToLower(strings.TrimSpace(p.Headers.Get("Content-Transfer-Encoding"))) {
+	case "8bit", "binary":
+		return true
+	}
+	for _, c := range p.Children {
+		if c.Uses8Bit() {
+			return true
+		}
+	}
+	return false
+}
+
+// Convert7Bit changes the transfer encoding of 8bit parts to quoted-printable for text and
+// base64 for other types, so the message can be relayed through servers without 8BITMIME
+func (p *Part) Convert7Bit() {
+	for _, c := range p.Children {
+		c.Convert7Bit()
+	}
+	p.convert7Bit()
+}
+
+// copy7Bit returns a copy of the part with 8bit parts converted as done by Convert7Bit, leaving
+// p unchanged. Parts without 8bit data are shared, and the pending Data of converted parts is
+// moved to the copy as writing p would have consumed it.
+func (p *Part) copy7Bit() *Part {
+	if !p.Uses8Bit() {
+		return p
+	}
+	c := *p
+	c.Headers = p.Headers.Merge(nil)
+	c.Children = make([]*Part, len(p.Children))
+	for n, child := range p.Children {
+		c.Children[n] = child.copy7Bit()
+	}
+	p.Data = nil
+	c.convert7Bit()
+	return &c
+}
+
+// convert7Bit changes the transfer encoding of the part itself if it is 8bit
+func (p *Part) convert7Bit() {
+	switch strings.ToLower(strings.TrimSpace(p.Headers.Get("Content-Transfer-Encoding"))) {
+	case "8bit", "binary":
+	default:
+		return
+	}
+	switch {
+	case p.IsContainer():
+		p.Headers.Set("Content-Transfer-Encoding", "7bit")
+	case strings.HasPrefix(p.Type, "text/"):
+		p.Headers.Set("Content-Transfer-Encoding", "quoted-printable")
+		p.Encoding = 'q'
+	default:
+		p.Headers.Set("Content-Transfer-Encoding", "base64")
+		p.Encoding = 'b'
+	}
+}
+
+// multipartType returns the Content-Type value for a multipart part, keeping any parameter
+// other than boundary found in the part's headers
+func (p *Part) multipartType() string {
+	_, params, err := mime.ParseMediaType(p.Headers.Get("Content-Type"))
+	if err != nil {
+		params = make(map[string]string)
+	}
+	params["boundary"] = p.Boundary
+	return mime.FormatMediaType(p.Type, params)
+}
+
 func (p *Part) readBody() ([]byte, error) {
 	if p.Data == nil {
 		if p.GetBody != nil {
@@ -165,8 +253,8 @@ func (p *Part) convertEncoder(w io.Writer) io.WriteCloser {
 	case 'q':
 		return quotedprintable.NewWriter(w)
 	case 'b':
-		breaker := &lineBreaker{out: w}
-		return base64.NewEncoder(base64.StdEncoding, breaker)
+		breaker := newStdLinebreaker(w)
+		return &chainCloser{WriteCloser: base64.NewEncoder(base64.StdEncoding, breaker), next: breaker}
 	default:
 		return nil
 	}
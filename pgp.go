@@ -0,0 +1,164 @@
+package pmail
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+)
+
+// PGPSigner creates OpenPGP detached signatures, to be implemented using an OpenPGP library.
+// Data is in canonical form (CRLF line endings) and should be signed as binary.
+type PGPSigner interface {
+	// SignDetached returns the ASCII armored signature of data, and the hash algorithm used
+	// as a micalg value such as "pgp-sha256" (RFC 3156 5)
+	SignDetached(data []byte) (sig []byte, micalg string, err error)
+}
+
+// PGPVerifier verifies OpenPGP detached signatures
+type PGPVerifier interface {
+	// VerifyDetached checks sig is a valid signature of data, and returns the signer identity
+	VerifyDetached(data, sig []byte) (signer string, err error)
+}
+
+// PGPEncrypter encrypts data for a set of recipients chosen by the implementation, returning
+// an ASCII armored OpenPGP message
+type PGPEncrypter interface {
+	Encrypt(data []byte) ([]byte, error)
+}
+
+// PGPDecrypter decrypts ASCII armored OpenPGP messages
+type PGPDecrypter interface {
+	Decrypt(data []byte) ([]byte, error)
+}
+
+var errNotPGP = errors.New("email is not a PGP/MIME message")
+
+// SignPGP signs the content of the email with PGP/MIME (RFC 3156). The body is replaced with a
+// multipart/signed part holding the content and its detached signature. The content cannot be
+// modified after signing.
+func (m *Mail) SignPGP(s PGPSigner) error {
+	content, err := m.contentEntity()
+	if err != nil {
+		return err
+	}
+	sig, micalg, err := s.SignDetached(content.raw)
+	if err != nil {
+		return err
+	}
+
+	sigPart := armoredPart("application/pgp-signature", "signature.asc", sig)
+	m.Body.Children = []*Part{signedPart(content, "application/pgp-signature", micalg, sigPart)}
+	return nil
+}
+
+// EncryptPGP encrypts the content of the email with PGP/MIME (RFC 3156). The email can be
+// signed before being encrypted.
+func (m *Mail) EncryptPGP(e PGPEncrypter) error {
+	content, err := m.contentEntity()
+	if err != nil {
+		return err
+	}
+	data, err := e.Encrypt(content.raw)
+	if err != nil {
+		return err
+	}
+
+	enc := NewPart("multipart/encrypted")
+	enc.Headers.Set("Content-Type", mime.FormatMediaType(enc.Type, map[string]string{
+		"protocol": "application/pgp-encrypted",
+		"boundary": enc.Boundary,
+	}))
+	enc.Append(armoredPart("application/pgp-encrypted", "", []byte("Version: 1\r\n")))
+	enc.Append(armoredPart("application/octet-stream", "encrypted.asc", data))
+	m.Body.Children = []*Part{enc}
+	return nil
+}
+
+// VerifyPGP verifies the signature of a PGP/MIME signed email, and returns the signer identity
+// as reported by v
+func (m *Mail) VerifyPGP(v PGPVerifier) (string, error) {
+	p := m.Body.FindType("multipart/signed", true)
+	if p == nil || !p.hasProtocol("application/pgp-signature") || len(p.Children) != 2 || p.Children[0].raw == nil {
+		return "", errNotPGP
+	}
+	sig, err := p.Children[1].readBody()
+	if err != nil {
+		return "", err
+	}
+	data := p.Children[0].raw
+	if !verifycrlf(data) {
+		// the signature is computed on the content with CRLF line endings (RFC 3156 5)
+		data = fixcrlf(data)
+	}
+	return v.VerifyDetached(data, sig)
+}
+
+// DecryptPGP decrypts a PGP/MIME encrypted email, replacing its content with the decrypted
+// one. If the content is signed, VerifyPGP can be called afterward.
+func (m *Mail) DecryptPGP(d PGPDecrypter) error {
+	p := m.Body.FindType("multipart/encrypted", true)
+	if p == nil || !p.hasProtocol("application/pgp-encrypted") || len(p.Children) != 2 {
+		return errNotPGP
+	}
+	data, err := p.Children[1].readBody()
+	if err != nil {
+		return err
+	}
+	plain, err := d.Decrypt(data)
+	if err != nil {
+		return err
+	}
+	content, err := ReadPart(bytes.NewReader(plain))
+	if err != nil {
+		return err
+	}
+	m.Body.replace(p, content)
+	return nil
+}
+
+// signedPart returns a multipart/signed part holding content and its signature
+func signedPart(content *Part, protocol, micalg string, sig *Part) *Part {
+	signed := NewPart("multipart/signed")
+	signed.Headers.Set("Content-Type", mime.FormatMediaType(signed.Type, map[string]string{
+		"protocol": protocol,
+		"micalg":   micalg,
+		"boundary": signed.Boundary,
+	}))
+	signed.Append(content)
+	signed.Append(sig)
+	return signed
+}
+
+// armoredPart returns a 7bit part holding ASCII armored data
+func armoredPart(typ, filename string, data []byte) *Part {
+	p := NewPart(typ)
+	p.Encoding = 0
+	p.Headers.Set("Content-Transfer-Encoding", "7bit")
+	if filename != "" {
+		p.Headers.Set("Content-Type", mime.FormatMediaType(typ, map[string]string{"name": filename}))
+	}
+	p.Data = io.NopCloser(bytes.NewReader(data))
+	p.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(data)), nil }
+	return p
+}
+
+// hasProtocol returns true if the protocol parameter of the part's Content-Type matches
+func (p *Part) hasProtocol(protocol string) bool {
+	_, params, err := mime.ParseMediaType(p.Headers.Get("Content-Type"))
+	return err == nil && params["protocol"] == protocol
+}
+
+// replace replaces old with c in the part tree, returning false if old was not found
+func (p *Part) replace(old, c *Part) bool {
+	for n, child := range p.Children {
+		if child == old {
+			p.Children[n] = c
+			return true
+		}
+		if child.replace(old, c) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package pmail_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/KarpelesLab/pmail"
+)
+
+// fakePGP stands in for an OpenPGP implementation: signatures are hashes and encryption is
+// base64 armor
+type fakePGP struct{}
+
+func (fakePGP) SignDetached(data []byte) ([]byte, string, error) {
+	sum := sha256.Sum256(data)
+	return []byte("-----BEGIN PGP SIGNATURE-----\r\n\r\n" + hex.EncodeToString(sum[:]) + "\r\n-----END PGP SIGNATURE-----\r\n"), "pgp-sha256", nil
+}
+
+func (f fakePGP) VerifyDetached(data, sig []byte) (string, error) {
+	expect, _, _ := f.SignDetached(data)
+	// like OpenPGP armor, the signature is not sensitive to line endings
+	cr := []byte("\r")
+	if !bytes.Equal(bytes.TrimSpace(bytes.ReplaceAll(sig, cr, nil)), bytes.TrimSpace(bytes.ReplaceAll(expect, cr, nil))) {
+		return "", errors.New("bad signature")
+	}
+	return "test@example.com", nil
+}
+
+func (fakePGP) Encrypt(data []byte) ([]byte, error) {
+	return []byte("-----BEGIN PGP MESSAGE-----\r\n\r\n" + base64.StdEncoding.EncodeToString(data) + "\r\n-----END PGP MESSAGE-----\r\n"), nil
+}
+
+func (fakePGP) Decrypt(data []byte) ([]byte, error) {
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\r\n"))
+	if len(lines) != 4 {
+		return nil, errors.New("bad message")
+	}
+	return base64.StdEncoding.DecodeString(string(lines[2]))
+}
+
+func writeParse(t *testing.T, m *pmail.Mail) ([]byte, *pmail.Mail) {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if _, err := m.WriteTo(buf); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	m2, err := pmail.Parse(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	return buf.Bytes(), m2
+}
+
+func TestSignPGP(t *testing.T) {
+	m := testMail()
+	if err := m.SignPGP(fakePGP{}); err != nil {
+		t.Fatalf("failed to sign: %s", err)
+	}
+	msg, m2 := writeParse(t, m)
+	for _, s := range []string{"multipart/signed;", `protocol="application/pgp-signature"`, "micalg=pgp-sha256"} {
+		if !bytes.Contains(msg, []byte(s)) {
+			t.Fatalf("missing %q in message:\n%s", s, msg)
+		}
+	}
+	if signer, err := m2.VerifyPGP(fakePGP{}); err != nil || signer != "test@example.com" {
+		t.Errorf("failed to verify: %v", err)
+	}
+
+	// any change to the signed content must be detected
+	tampered := bytes.Replace(msg, []byte("Hello"), []byte("Hullo"), 1)
+	m3, err := pmail.Parse(bytes.NewReader(tampered))
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	if _, err := m3.VerifyPGP(fakePGP{}); err == nil {
+		t.Errorf("tampered message verified")
+	}
+
+	// messages stored with LF line endings verify as well
+	m4, err := pmail.Parse(bytes.NewReader(bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n"))))
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	if signer, err := m4.VerifyPGP(fakePGP{}); err != nil || signer != "test@example.com" {
+		t.Errorf("failed to verify message with LF line endings: %v", err)
+	}
+
+	if _, err := testMail().VerifyPGP(fakePGP{}); err == nil {
+		t.Errorf("unsigned message verified")
+	}
+}
+
+func TestEncryptPGP(t *testing.T) {
+	m := testMail()
+	if err := m.SignPGP(fakePGP{}); err != nil {
+		t.Fatalf("failed to sign: %s", err)
+	}
+	if err := m.EncryptPGP(fakePGP{}); err != nil {
+		t.Fatalf("failed to encrypt: %s", err)
+	}
+	msg, m2 := writeParse(t, m)
+	if !bytes.Contains(msg, []byte(`protocol="application/pgp-encrypted"`)) || !bytes.Contains(msg, []byte("Version: 1")) || bytes.Contains(msg, []byte("Hello")) {
+		t.Fatalf("unexpected message:\n%s", msg)
+	}
+
+	if err := m2.DecryptPGP(fakePGP{}); err != nil {
+		t.Fatalf("failed to decrypt: %s", err)
+	}
+	if _, err := m2.VerifyPGP(fakePGP{}); err != nil {
+		t.Errorf("failed to verify decrypted message: %s", err)
+	}
+	p := m2.Body.FindType("text/plain", true)
+	if p == nil {
+		t.Fatalf("no text part in decrypted message")
+	}
+	if data, _ := io.ReadAll(p.Data); string(data) != "Hello" {
+		t.Errorf("unexpected text %q", data)
+	}
+}
@@ -0,0 +1,80 @@
+package pmailtest_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/KarpelesLab/pmail"
+	"github.com/KarpelesLab/pmail/pmailtest"
+)
+
+func testMail() *pmail.Mail {
+	m := pmail.New()
+	m.SetFrom("test@example.com")
+	m.AddTo("bob@example.com")
+	m.AddBcc("carol@example.com")
+	m.SetSubject("Hello")
+	m.SetBodyText("Hello world")
+	return m
+}
+
+func TestRecorder(t *testing.T) {
+	r := &pmailtest.Recorder{}
+	if err := testMail().Send(r); err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	msg := r.Last()
+	if msg == nil || len(r.Messages()) != 1 {
+		t.Fatalf("message was not recorded")
+	}
+	if got := msg.Envelope.Addresses(); len(got) != 2 || got[1] != "carol@example.com" {
+		t.Errorf("unexpected recipients %v", got)
+	}
+	if msg.Mail.Body.Headers.Get("Subject") != "Hello" || msg.Mail.Body.Headers.Get("Bcc") != "" {
+		t.Errorf("unexpected message:\n%s", msg.Data)
+	}
+
+	r.Reset()
+	r.Err = errors.New("failure")
+	if err := testMail().Send(r); err != r.Err || r.Last() != nil {
+		t.Errorf("expected failure, got %v", err)
+	}
+}
+
+func TestServer(t *testing.T) {
+	s := pmailtest.NewUnstartedServer()
+	s.RequireAuth("user", "secret")
+	s.StartTLS()
+	defer s.Close()
+
+	if err := testMail().Send(s.Sender()); err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	msg := s.Last()
+	if msg == nil || msg.Envelope.From != "test@example.com" || len(msg.Envelope.Recipients) != 2 {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+
+	// scripted failures
+	s.FailRcpt("carol@example.com", &pmail.SMTPError{Code: 450, Enhanced: "4.2.1", Message: "Try again later"})
+	sender := s.Sender()
+	sender.PartialDelivery = true
+	res, err := testMail().Deliver(context.Background(), sender)
+	if err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	if len(res.Accepted) != 1 || len(res.Rejected) != 1 || !res.Rejected[0].Temporary() || res.Rejected[0].Recipient != "carol@example.com" {
+		t.Errorf("unexpected result: %+v", res)
+	}
+
+	s.ClearFailures()
+	s.FailData(&pmail.SMTPError{Code: 554, Enhanced: "5.7.1", Message: "Spam"})
+	var se *pmail.SMTPError
+	if err := testMail().Send(s.Sender()); !errors.As(err, &se) || se.Code != 554 || se.Phase != pmail.PhaseData {
+		t.Errorf("expected data failure, got %v", err)
+	}
+	if len(s.Messages()) != 2 {
+		t.Errorf("expected 2 messages, got %d", len(s.Messages()))
+	}
+}
@@ -0,0 +1,84 @@
+// Package pmailtest provides utilities for testing code sending emails: a Sender recording
+// messages, and a local SMTP server to test RelaySender end to end.
+package pmailtest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/KarpelesLab/pmail"
+)
+
+// Message is a message received by a Recorder or a Server
+type Message struct {
+	Envelope *pmail.Envelope
+	Mail     *pmail.Mail // parsed message
+	Data     []byte      // raw message
+}
+
+// Recorder is a pmail.Sender recording the messages sent through it. It is safe for
+// concurrent use.
+type Recorder struct {
+	// Err, if set, is returned by Send instead of recording the message
+	Err error
+
+	mu   sync.Mutex
+	msgs []*Message
+}
+
+// Send records the message
+func (r *Recorder) Send(from string, to []string, msg io.WriterTo) error {
+	return r.SendContext(context.Background(), pmail.NewEnvelope(from, to...), msg)
+}
+
+// SendContext records the message along with its envelope
+func (r *Recorder) SendContext(ctx context.Context, env *pmail.Envelope, msg io.WriterTo) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if r.Err != nil {
+		return r.Err
+	}
+	buf := &bytes.Buffer{}
+	if _, err := msg.WriteTo(buf); err != nil {
+		return err
+	}
+	m, err := pmail.Parse(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return err
+	}
+	r.record(&Message{Envelope: env, Mail: m, Data: buf.Bytes()})
+	return nil
+}
+
+func (r *Recorder) record(msg *Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.msgs = append(r.msgs, msg)
+}
+
+// Messages returns the recorded messages, in the order they were sent
+func (r *Recorder) Messages() []*Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Message(nil), r.msgs...)
+}
+
+// Last returns the last recorded message, or nil if none
+func (r *Recorder) Last() *Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.msgs) == 0 {
+		return nil
+	}
+	return r.msgs[len(r.msgs)-1]
+}
+
+// Reset forgets the recorded messages
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.msgs = nil
+}
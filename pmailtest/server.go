@@ -0,0 +1,251 @@
+package pmailtest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KarpelesLab/pmail"
+	"github.com/KarpelesLab/pmail/smtpd"
+)
+
+// Server is a SMTP server listening on 127.0.0.1, recording the messages it receives
+type Server struct {
+	Config *smtpd.Server // server configuration, may be modified before Start or StartTLS
+	Host   string        // address the server listens on, set by Start
+	Port   int
+
+	rec      Recorder
+	l        net.Listener
+	cert     *x509.Certificate
+	username string
+	password string
+
+	mu       sync.Mutex
+	failMail map[string]*pmail.SMTPError
+	failRcpt map[string]*pmail.SMTPError
+	failData *pmail.SMTPError
+}
+
+// NewServer returns a new started server
+func NewServer() *Server {
+	s := NewUnstartedServer()
+	s.Start()
+	return s
+}
+
+// NewTLSServer returns a new started server supporting STARTTLS with a generated certificate
+func NewTLSServer() *Server {
+	s := NewUnstartedServer()
+	s.StartTLS()
+	return s
+}
+
+// NewUnstartedServer returns a new server, which can be configured before calling Start or
+// StartTLS
+func NewUnstartedServer() *Server {
+	s := &Server{
+		failMail: make(map[string]*pmail.SMTPError),
+		failRcpt: make(map[string]*pmail.SMTPError),
+	}
+	s.Config = &smtpd.Server{Hostname: "localhost", Handler: &handler{s}}
+	return s
+}
+
+// Start starts listening on a random port of 127.0.0.1
+func (s *Server) Start() {
+	if s.l != nil {
+		panic("pmailtest: server already started")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("pmailtest: failed to listen: %s", err))
+	}
+	s.l = l
+	s.Host = "127.0.0.1"
+	s.Port = l.Addr().(*net.TCPAddr).Port
+	go s.Config.Serve(l)
+}
+
+// StartTLS enables STARTTLS with a generated certificate valid for 127.0.0.1, then starts the
+// server
+func (s *Server) StartTLS() {
+	cfg, cert, err := generateTLSConfig()
+	if err != nil {
+		panic(fmt.Sprintf("pmailtest: failed to generate certificate: %s", err))
+	}
+	s.cert = cert
+	s.Config.TLSConfig = cfg
+	s.Start()
+}
+
+// Close shuts down the server
+func (s *Server) Close() {
+	s.Config.Close()
+}
+
+// Addr returns the address of the server as host:port
+func (s *Server) Addr() string {
+	return net.JoinHostPort(s.Host, fmt.Sprint(s.Port))
+}
+
+// Certificate returns the certificate used for STARTTLS, or nil if TLS is not enabled
+func (s *Server) Certificate() *x509.Certificate {
+	return s.cert
+}
+
+// RequireAuth makes the server require authentication with the given credentials. It must be
+// called before the server is started.
+func (s *Server) RequireAuth(username, password string) {
+	s.username, s.password = username, password
+	s.Config.RequireAuth = true
+	s.Config.AllowInsecureAuth = true
+	s.Config.Authenticate = func(_ *smtpd.Session, u, p string) error {
+		if u != username || p != password {
+			return errors.New("invalid credentials")
+		}
+		return nil
+	}
+}
+
+// Sender returns a RelaySender configured to send messages to the server, trusting its
+// certificate and using its credentials
+func (s *Server) Sender() *pmail.RelaySender {
+	r := &pmail.RelaySender{Host: s.Host, Port: s.Port}
+	if s.cert != nil {
+		pool := x509.NewCertPool()
+		pool.AddCert(s.cert)
+		r.TLSConfig = &tls.Config{RootCAs: pool}
+		r.RequireTLS = true
+	}
+	if s.username != "" {
+		r.Auth = pmail.PasswordAuth(s.username, s.password, s.Host)
+	}
+	return r
+}
+
+// FailMail makes the server reply to MAIL FROM with the given error for the given sender, or
+// any sender if from is "*"
+func (s *Server) FailMail(from string, err *pmail.SMTPError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failMail[strings.ToLower(from)] = err
+}
+
+// FailRcpt makes the server reply to RCPT TO with the given error for the given recipient, or
+// any recipient if to is "*". For example a 450 reply simulates a temporary failure.
+func (s *Server) FailRcpt(to string, err *pmail.SMTPError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failRcpt[strings.ToLower(to)] = err
+}
+
+// FailData makes the server reply with the given error once messages are received
+func (s *Server) FailData(err *pmail.SMTPError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failData = err
+}
+
+// ClearFailures removes all scripted failures
+func (s *Server) ClearFailures() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failMail = make(map[string]*pmail.SMTPError)
+	s.failRcpt = make(map[string]*pmail.SMTPError)
+	s.failData = nil
+}
+
+// Messages returns the messages received by the server, in the order they were received
+func (s *Server) Messages() []*Message {
+	return s.rec.Messages()
+}
+
+// Last returns the last message received by the server, or nil if none
+func (s *Server) Last() *Message {
+	return s.rec.Last()
+}
+
+// Reset forgets the received messages
+func (s *Server) Reset() {
+	s.rec.Reset()
+}
+
+// failure returns the scripted failure for addr, if any
+func (s *Server) failure(list map[string]*pmail.SMTPError, addr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err, ok := list[strings.ToLower(addr)]; ok {
+		return err
+	}
+	if err, ok := list["*"]; ok {
+		return err
+	}
+	return nil
+}
+
+// handler receives messages for a Server
+type handler struct {
+	s *Server
+}
+
+func (h *handler) CheckMail(ctx context.Context, _ *smtpd.Session, from string) error {
+	return h.s.failure(h.s.failMail, from)
+}
+
+func (h *handler) CheckRcpt(ctx context.Context, _ *smtpd.Session, to string) error {
+	return h.s.failure(h.s.failRcpt, to)
+}
+
+func (h *handler) ServeSMTP(ctx context.Context, sess *smtpd.Session, env *pmail.Envelope, m *pmail.Mail) error {
+	h.s.mu.Lock()
+	err := h.s.failData
+	h.s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	h.s.rec.record(&Message{Envelope: env, Mail: m, Data: append([]byte(nil), sess.Data...)})
+	return nil
+}
+
+// generateTLSConfig returns a TLS configuration using a self-signed certificate valid for
+// 127.0.0.1 and localhost
+func generateTLSConfig() (*tls.Config, *x509.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}}}
+	return cfg, cert, nil
+}
@@ -0,0 +1,223 @@
+package pmail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// RelayPool sends emails through a relay server, keeping authenticated sessions open between
+// messages instead of connecting for each email. It is safe for concurrent use.
+//
+// There is no background cleanup: idle connections are checked when they are taken from the
+// pool for a new email, and stay open until then or until Close is called.
+type RelayPool struct {
+	Relay       *RelaySender
+	MaxConns    int           // maximum number of concurrent connections, defaults to 4
+	MaxMessages int           // messages sent on a connection before reconnecting, 0 for no limit
+	IdleTimeout time.Duration // connections idle for longer are closed instead of reused, defaults to 1 minute
+	CheckAfter  time.Duration // idle connections are checked with NOOP before reuse after this delay, defaults to 5 seconds
+
+	initOnce sync.Once
+	slots    chan struct{}
+	mu       sync.Mutex
+	idle     []*pooledConn
+	closed   bool
+}
+
+type pooledConn struct {
+	cl       *smtpClient
+	sent     int
+	lastUsed time.Time
+}
+
+var ErrPoolClosed = errors.New("relay pool is closed")
+
+// NewRelayPool returns a new pool sending emails through r with at most maxConns connections
+func NewRelayPool(r *RelaySender, maxConns int) *RelayPool {
+	return &RelayPool{Relay: r, MaxConns: maxConns}
+}
+
+func (p *RelayPool) init() {
+	n := p.MaxConns
+	if n <= 0 {
+		n = 4
+	}
+	p.slots = make(chan struct{}, n)
+}
+
+// Send sends the email using a pooled connection
+func (p *RelayPool) Send(from string, to []string, msg io.WriterTo) error {
+	return p.SendContext(context.Background(), NewEnvelope(from, to...), msg)
+}
+
+// SendEnvelope sends the email using a pooled connection and the given envelope
+func (p *RelayPool) SendEnvelope(env *Envelope, msg io.WriterTo) error {
+	return p.SendContext(context.Background(), env, msg)
+}
+
+// SendContext sends the email using a pooled connection and the given envelope. If the
+// connection turns out to be broken or the server closes it (421) before the message was
+// transmitted, the email is sent again on a new connection.
+func (p *RelayPool) SendContext(ctx context.Context, env *Envelope, msg io.WriterTo) error {
+	res, err := p.Deliver(ctx, env, msg)
+	if err != nil {
+		return err
+	}
+	return res.Err()
+}
+
+// Deliver sends the email using a pooled connection and returns the result for each recipient.
+// See RelaySender.Deliver.
+func (p *RelayPool) Deliver(ctx context.Context, env *Envelope, msg io.WriterTo) (*SendResult, error) {
+	p.initOnce.Do(p.init)
+
+	// wait for a free slot
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-p.slots }()
+
+	// messages other than Mail may only be readable once, keep a copy to send them again
+	if _, ok := msg.(writer7Bit); !ok {
+		buf := &bytes.Buffer{}
+		if _, err := msg.WriteTo(buf); err != nil {
+			return nil, err
+		}
+		msg = &replayWriter{buf.Bytes()}
+	}
+
+	for {
+		pc, reused, err := p.get(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+
+		stop := watchContext(ctx, pc.cl.conn)
+		res, err := sendSMTPEnvelope(pc.cl, env, msg, p.Relay.PartialDelivery)
+		stop()
+
+		if err == nil {
+			pc.sent++
+			p.put(pc)
+			return res, nil
+		}
+		if ctx.Err() != nil {
+			pc.cl.close()
+			return res, ctx.Err()
+		}
+		if !isBrokenConn(err) {
+			// protocol error such as a rejected recipient, the connection can still be used
+			p.put(pc)
+			return res, err
+		}
+		pc.cl.close()
+		var se *SMTPError
+		if !reused || (errors.As(err, &se) && se.Phase == PhaseData) {
+			// the server may have received the message, do not send it twice
+			return res, err
+		}
+		// the server may have closed an idle connection, try again with a new one
+	}
+}
+
+// get returns an idle connection, or a new one. reused is true if the connection was
+// already used before.
+func (p *RelayPool) get(ctx context.Context) (pc *pooledConn, reused bool, err error) {
+	idleTimeout := timeoutOrDefault(p.IdleTimeout, time.Minute)
+	checkAfter := timeoutOrDefault(p.CheckAfter, 5*time.Second)
+
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, false, ErrPoolClosed
+		}
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			break
+		}
+		pc = p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		idle := time.Since(pc.lastUsed)
+		if idle > idleTimeout {
+			// server has likely dropped the connection already
+			pc.cl.close()
+			continue
+		}
+		if idle > checkAfter {
+			// health check
+			stop := watchContext(ctx, pc.cl.conn)
+			err := pc.cl.noop()
+			stop()
+			if err != nil {
+				pc.cl.close()
+				continue
+			}
+		}
+		return pc, true, nil
+	}
+
+	cl, err := p.Relay.dial(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	return &pooledConn{cl: cl}, false, nil
+}
+
+// put resets the connection and returns it to the pool, or closes it if it cannot be reused
+func (p *RelayPool) put(pc *pooledConn) {
+	if p.MaxMessages > 0 && pc.sent >= p.MaxMessages {
+		pc.cl.quit()
+		return
+	}
+	if err := pc.cl.reset(); err != nil {
+		pc.cl.close()
+		return
+	}
+	pc.lastUsed = time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		pc.cl.quit()
+		return
+	}
+	p.idle = append(p.idle, pc)
+}
+
+// Close closes all idle connections. Connections in use are closed once their email has been
+// sent, and further calls to Send will fail.
+func (p *RelayPool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mu.Unlock()
+
+	for _, pc := range idle {
+		pc.cl.quit()
+	}
+	return nil
+}
+
+// isBrokenConn returns true if err means the connection cannot be used anymore
+func isBrokenConn(err error) bool {
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		// 421 <domain> Service not available, closing transmission channel
+		return tpErr.Code == 421
+	}
+	return isNetworkError(err)
+}
@@ -0,0 +1,109 @@
+package pmail_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/pmail"
+)
+
+func TestRelayPool(t *testing.T) {
+	srv := newFakeSMTP(t, "").start()
+	p := pmail.NewRelayPool(&pmail.RelaySender{Host: "127.0.0.1", Port: srv.port()}, 2)
+	p.MaxMessages = 3
+	defer p.Close()
+
+	for i := 0; i < 4; i++ {
+		if err := testMail().Send(p); err != nil {
+			t.Fatalf("failed to send mail %d: %s", i, err)
+		}
+	}
+
+	srv.mu.Lock()
+	conns, msgs := srv.conn, len(srv.msgs)
+	srv.mu.Unlock()
+	if msgs != 4 {
+		t.Errorf("expected 4 messages, got %d", msgs)
+	}
+	if conns != 2 {
+		t.Errorf("expected 2 connections, got %d", conns)
+	}
+	rset := 0
+	for _, c := range srv.commands() {
+		if c == "RSET" {
+			rset++
+		}
+	}
+	if rset < 2 {
+		t.Errorf("expected RSET between messages, got %v", srv.commands())
+	}
+}
+
+func TestRelayPoolReconnect(t *testing.T) {
+	srv := newFakeSMTP(t, "")
+	srv.fail["NOOP"] = "421 4.3.2 shutting down"
+	srv.start()
+
+	p := pmail.NewRelayPool(&pmail.RelaySender{Host: "127.0.0.1", Port: srv.port()}, 1)
+	p.CheckAfter = time.Millisecond
+	defer p.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := testMail().Send(p); err != nil {
+			t.Fatalf("failed to send mail %d: %s", i, err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.conn != 2 || len(srv.msgs) != 2 {
+		t.Errorf("expected 2 connections and 2 messages, got %d and %d", srv.conn, len(srv.msgs))
+	}
+}
+
+func TestRelayPoolQueue(t *testing.T) {
+	srv := newFakeSMTP(t, "")
+	srv.ext = []string{"SIZE 100000"}
+	srv.start()
+	received := func() []string {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return append([]string(nil), srv.msgs...)
+	}
+
+	p := pmail.NewRelayPool(&pmail.RelaySender{Host: "127.0.0.1", Port: srv.port()}, 1)
+	defer p.Close()
+	q, err := pmail.NewQueue(t.TempDir(), p)
+	if err != nil {
+		t.Fatalf("failed to create queue: %s", err)
+	}
+	q.Start()
+	defer q.Close()
+
+	if err := testMail().Send(q); err != nil {
+		t.Fatalf("failed to queue: %s", err)
+	}
+	waitFor(t, func() bool { return len(received()) == 1 })
+
+	// the server drops the idle connection, the queued message must be sent again in full
+	srv.mu.Lock()
+	srv.once["MAIL"] = "421 4.4.2 idle timeout"
+	srv.mu.Unlock()
+	m := testMail()
+	m.SetSubject("Second")
+	if err := m.Send(q); err != nil {
+		t.Fatalf("failed to queue: %s", err)
+	}
+	waitFor(t, func() bool { return len(received()) == 2 })
+
+	if msg := received()[1]; !strings.Contains(msg, "Subject: Second\r\n") || !strings.HasSuffix(msg, "Hello\r\n") {
+		t.Errorf("unexpected message after reconnection:\n%s", msg)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.conn != 2 {
+		t.Errorf("expected 2 connections, got %d", srv.conn)
+	}
+}
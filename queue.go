@@ -0,0 +1,483 @@
+package pmail
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KarpelesLab/rndpass"
+)
+
+// Queue spools messages to a directory and delivers them through Sender in the background,
+// retrying temporary failures with exponential backoff. Messages still queued when the process
+// exits are delivered once a Queue is started again on the same directory.
+//
+// Queues must be created with NewQueue. Each message is stored as <id>.msg holding the message
+// and <id>.json holding its envelope and delivery state. Messages that permanently failed, or
+// could not be delivered before MaxAge, are moved to the "dead" subdirectory, with the error of
+// each failed recipient.
+type Queue struct {
+	Sender     Sender
+	Dir        string
+	Workers    int           // number of concurrent deliveries, defaults to 4
+	MinBackoff time.Duration // delay before the first retry, defaults to 1 minute
+	MaxBackoff time.Duration // maximum delay between retries, defaults to 1 hour
+	MaxAge     time.Duration // age after which messages are not retried anymore, defaults to 5 days
+
+	// OnFailure, if set, is called when a message is moved to the dead letter directory, with
+	// the recipients that did not receive it
+	OnFailure func(id string, env *Envelope, err error)
+
+	mu       sync.Mutex
+	entries  map[string]*queueEntry
+	inflight map[string]bool
+	wake     chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	started  bool
+}
+
+// queueEntry is the delivery state of a queued message, stored as <id>.json
+type queueEntry struct {
+	ID          string    `json:"-"`
+	Envelope    *Envelope `json:"envelope"`
+	Created     time.Time `json:"created"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+
+	// Errors holds the error of each failed recipient, for dead letters
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+const (
+	defaultQueueWorkers = 4
+	defaultMinBackoff   = time.Minute
+	defaultMaxBackoff   = time.Hour
+	defaultMaxAge       = 5 * 24 * time.Hour // RFC 5321 4.5.4.1
+	queueDeadDir        = "dead"
+)
+
+// NewQueue returns a queue delivering messages through s, spooled in dir. Messages already
+// present in dir are loaded. Start must be called for messages to be delivered.
+func NewQueue(dir string, s Sender) (*Queue, error) {
+	q := &Queue{Sender: s, Dir: dir}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// load creates the spool directories if needed and reads the queued messages
+func (q *Queue) load() error {
+	q.entries = make(map[string]*queueEntry)
+	q.inflight = make(map[string]bool)
+	q.wake = make(chan struct{}, 1)
+	if err := os.MkdirAll(filepath.Join(q.Dir, queueDeadDir), 0700); err != nil {
+		return err
+	}
+
+	files, err := os.ReadDir(q.Dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasPrefix(name, ".tmp-") {
+			// leftover of an interrupted write
+			os.Remove(filepath.Join(q.Dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		id := strings.TrimSuffix(name, ".json")
+		data, err := os.ReadFile(filepath.Join(q.Dir, name))
+		if err != nil {
+			return err
+		}
+		e := &queueEntry{}
+		if err := json.Unmarshal(data, e); err != nil {
+			return fmt.Errorf("queue entry %s: %w", id, err)
+		}
+		e.ID = id
+		q.entries[id] = e
+	}
+
+	// remove messages whose state was never written, as Enqueue failed or was interrupted
+	for _, f := range files {
+		id := strings.TrimSuffix(f.Name(), ".msg")
+		if _, ok := q.entries[id]; !ok && id != f.Name() {
+			os.Remove(filepath.Join(q.Dir, f.Name()))
+		}
+	}
+	return nil
+}
+
+// Send queues the email for delivery
+func (q *Queue) Send(from string, to []string, msg io.WriterTo) error {
+	return q.SendContext(context.Background(), NewEnvelope(from, to...), msg)
+}
+
+// SendEnvelope queues the email for delivery using the given envelope
+func (q *Queue) SendEnvelope(env *Envelope, msg io.WriterTo) error {
+	return q.SendContext(context.Background(), env, msg)
+}
+
+// SendContext queues the email for delivery using the given envelope. An error is returned
+// only if the message could not be written to the spool directory.
+func (q *Queue) SendContext(ctx context.Context, env *Envelope, msg io.WriterTo) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err := q.Enqueue(env, msg)
+	return err
+}
+
+// RecipientsFromHeaders returns true if the underlying sender reads the recipients from the
+// message headers
+func (q *Queue) RecipientsFromHeaders() bool {
+	rh, ok := q.Sender.(RecipientsFromHeaders)
+	return ok && rh.RecipientsFromHeaders()
+}
+
+// Enqueue writes the message to the spool directory and returns its id. 8bit parts are
+// converted to 7bit first, as the capabilities of the server are not known at this point.
+func (q *Queue) Enqueue(env *Envelope, msg io.WriterTo) (string, error) {
+	if len(env.Recipients) == 0 {
+		return "", errors.New("cannot queue email: envelope has no recipients")
+	}
+	if c, ok := msg.(writer7Bit); ok && env.EightBitMIME {
+		msg = writerToFunc(c.writeTo7Bit)
+		e := *env
+		e.EightBitMIME = false
+		env = &e
+	}
+	buf := &bytes.Buffer{}
+	if _, err := msg.WriteTo(buf); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	e := &queueEntry{
+		ID:          fmt.Sprintf("%d-%s", now.UnixNano(), rndpass.Code(12, rndpass.RangeAlnumLower)),
+		Envelope:    env,
+		Created:     now,
+		NextAttempt: now,
+	}
+	if err := writeFileAtomic(q.Dir, e.ID+".msg", buf.Bytes()); err != nil {
+		return "", err
+	}
+	// the entry is only considered queued once its state file exists
+	if err := q.writeEntry(q.Dir, e); err != nil {
+		os.Remove(filepath.Join(q.Dir, e.ID+".msg"))
+		return "", err
+	}
+
+	q.mu.Lock()
+	q.entries[e.ID] = e
+	q.mu.Unlock()
+	q.notify()
+	return e.ID, nil
+}
+
+// Len returns the number of messages waiting for delivery
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
+
+// Start starts the delivery workers
+func (q *Queue) Start() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.started {
+		return
+	}
+	q.started = true
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+
+	n := q.Workers
+	if n <= 0 {
+		n = defaultQueueWorkers
+	}
+	for i := 0; i < n; i++ {
+		q.wg.Add(1)
+		go q.worker()
+	}
+}
+
+// Close stops the workers, interrupting deliveries in progress. Interrupted messages stay in
+// the queue and will be delivered again.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	if !q.started {
+		q.mu.Unlock()
+		return nil
+	}
+	q.started = false
+	q.cancel()
+	q.mu.Unlock()
+	q.wg.Wait()
+	return nil
+}
+
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) worker() {
+	defer q.wg.Done()
+	for {
+		e, wait := q.take()
+		if e != nil {
+			q.attempt(e)
+			continue
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-q.wake:
+		case <-t.C:
+		case <-q.ctx.Done():
+			t.Stop()
+			return
+		}
+		t.Stop()
+	}
+}
+
+// take returns an entry due for delivery, or the delay until the next one is
+func (q *Queue) take() (*queueEntry, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.ctx.Err() != nil {
+		return nil, 0
+	}
+
+	now := time.Now()
+	var due *queueEntry
+	wait := time.Hour
+	for id, e := range q.entries {
+		if q.inflight[id] {
+			continue
+		}
+		if d := e.NextAttempt.Sub(now); d > 0 {
+			if d < wait {
+				wait = d
+			}
+			continue
+		}
+		if due != nil {
+			// more entries are due, let another worker handle them
+			q.notify()
+			break
+		}
+		due = e
+	}
+	if due != nil {
+		q.inflight[due.ID] = true
+	}
+	return due, wait
+}
+
+// attempt tries to deliver the entry, and updates its state depending on the outcome
+func (q *Queue) attempt(e *queueEntry) {
+	defer func() {
+		q.mu.Lock()
+		delete(q.inflight, e.ID)
+		q.mu.Unlock()
+	}()
+
+	data, err := os.ReadFile(filepath.Join(q.Dir, e.ID+".msg"))
+	if err != nil {
+		q.fail(e, e.Envelope.Recipients, err)
+		q.remove(e)
+		return
+	}
+
+	var res *SendResult
+	if rs, ok := q.Sender.(ResultSender); ok {
+		res, err = rs.Deliver(q.ctx, e.Envelope, bytes.NewReader(data))
+	} else {
+		err = sendContext(q.ctx, q.Sender, e.Envelope, bytes.NewReader(data))
+	}
+	if q.ctx.Err() != nil {
+		// interrupted by Close, try again on next start
+		return
+	}
+
+	retry, failed, failErr := deliveryOutcome(e.Envelope, res, err)
+	if len(failed) > 0 {
+		q.fail(e, failed, failErr)
+	}
+
+	e.Attempts++
+	if err != nil {
+		e.LastError = err.Error()
+	} else if len(retry) > 0 {
+		e.LastError = res.Err().Error()
+	}
+	if len(retry) > 0 && time.Since(e.Created) > q.maxAge() {
+		q.fail(e, retry, fmt.Errorf("message expired after %d attempts: %s", e.Attempts, e.LastError))
+		retry = nil
+	}
+	if len(retry) == 0 {
+		q.remove(e)
+		return
+	}
+
+	env := *e.Envelope
+	env.Recipients = retry
+	e.Envelope = &env
+	e.NextAttempt = time.Now().Add(q.backoff(e.Attempts))
+	q.writeEntry(q.Dir, e)
+	q.notify()
+}
+
+// deliveryOutcome returns the recipients that should be retried, and those that failed
+// permanently along with the error. Errors that are not *SMTPError are considered temporary.
+func deliveryOutcome(env *Envelope, res *SendResult, err error) ([]*Recipient, []*Recipient, error) {
+	rejected := make(map[string]*SMTPError)
+	if res != nil {
+		for _, e := range res.Rejected {
+			rejected[e.Recipient] = e
+		}
+	}
+	var se *SMTPError
+	isSMTP := errors.As(err, &se)
+	if res == nil && isSMTP && se.Recipient != "" {
+		rejected[se.Recipient] = se
+	}
+	// the whole message was refused, not only some recipients
+	permanent := isSMTP && se.Permanent() && se.Phase != PhaseRcpt && se.Recipient == ""
+
+	var retry, failed []*Recipient
+	var failErr error
+	for _, rcpt := range env.Recipients {
+		if e, ok := rejected[rcpt.Address]; ok {
+			if e.Permanent() {
+				failed = append(failed, rcpt)
+				failErr = e
+			} else {
+				retry = append(retry, rcpt)
+			}
+			continue
+		}
+		switch {
+		case err == nil:
+			// delivered
+		case permanent:
+			failed = append(failed, rcpt)
+			failErr = err
+		default:
+			retry = append(retry, rcpt)
+		}
+	}
+	if len(failed) > 1 && res != nil && len(res.Rejected) > 1 {
+		failErr = res.Err()
+	}
+	return retry, failed, failErr
+}
+
+// fail copies the message to the dead letter directory for the given recipients. If the
+// message already failed for other recipients, they are kept in the same dead letter.
+func (q *Queue) fail(e *queueEntry, rcpts []*Recipient, err error) {
+	env := *e.Envelope
+	env.Recipients = rcpts
+	deadDir := filepath.Join(q.Dir, queueDeadDir)
+
+	dead := &queueEntry{}
+	if data, rerr := os.ReadFile(filepath.Join(deadDir, e.ID+".json")); rerr != nil || json.Unmarshal(data, dead) != nil || dead.Envelope == nil {
+		all := env
+		all.Recipients = nil
+		dead = &queueEntry{Envelope: &all, Errors: make(map[string]string)}
+		if data, rerr := os.ReadFile(filepath.Join(q.Dir, e.ID+".msg")); rerr == nil {
+			writeFileAtomic(deadDir, e.ID+".msg", data)
+		}
+	}
+	if dead.Errors == nil {
+		dead.Errors = make(map[string]string)
+	}
+	dead.ID, dead.Created, dead.Attempts, dead.LastError = e.ID, e.Created, e.Attempts, err.Error()
+	for _, rcpt := range rcpts {
+		if _, ok := dead.Errors[rcpt.Address]; !ok {
+			dead.Envelope.Recipients = append(dead.Envelope.Recipients, rcpt)
+		}
+		dead.Errors[rcpt.Address] = err.Error()
+	}
+	q.writeEntry(deadDir, dead)
+
+	if q.OnFailure != nil {
+		q.OnFailure(e.ID, &env, err)
+	}
+}
+
+// remove deletes the entry from the queue
+func (q *Queue) remove(e *queueEntry) {
+	q.mu.Lock()
+	delete(q.entries, e.ID)
+	q.mu.Unlock()
+	// remove the state first so a crash cannot leave an entry without its message
+	os.Remove(filepath.Join(q.Dir, e.ID+".json"))
+	os.Remove(filepath.Join(q.Dir, e.ID+".msg"))
+}
+
+func (q *Queue) writeEntry(dir string, e *queueEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(dir, e.ID+".json", data)
+}
+
+// backoff returns the delay before the next attempt, doubling after each attempt
+func (q *Queue) backoff(attempts int) time.Duration {
+	min, max := timeoutOrDefault(q.MinBackoff, defaultMinBackoff), timeoutOrDefault(q.MaxBackoff, defaultMaxBackoff)
+	d := min
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+func (q *Queue) maxAge() time.Duration {
+	return timeoutOrDefault(q.MaxAge, defaultMaxAge)
+}
+
+// writeFileAtomic writes data to a temporary file then renames it, so readers never see a
+// partially written file
+func writeFileAtomic(dir, name string, data []byte) error {
+	f, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(dir, name))
+}
@@ -0,0 +1,139 @@
+package pmail_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/pmail"
+	"github.com/KarpelesLab/pmail/pmailtest"
+)
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for condition")
+}
+
+func TestQueueRetry(t *testing.T) {
+	dir := t.TempDir()
+	srv := pmailtest.NewServer()
+	defer srv.Close()
+	srv.FailRcpt("carol@example.com", &pmail.SMTPError{Code: 450, Enhanced: "4.2.0", Message: "Greylisted"})
+	sender := srv.Sender()
+	sender.PartialDelivery = true
+
+	// queue a message without delivering it, and reload the queue as after a restart
+	q, err := pmail.NewQueue(dir, sender)
+	if err != nil {
+		t.Fatalf("failed to create queue: %s", err)
+	}
+	m := testMail()
+	m.AddCc("carol@example.com")
+	if err := m.Send(q); err != nil {
+		t.Fatalf("failed to queue: %s", err)
+	}
+	os.WriteFile(filepath.Join(dir, "orphan.msg"), []byte("Subject: orphan\r\n\r\n"), 0600)
+	q, err = pmail.NewQueue(dir, sender)
+	if err != nil {
+		t.Fatalf("failed to reload queue: %s", err)
+	}
+	if q.Len() != 1 {
+		t.Fatalf("expected 1 queued message, got %d", q.Len())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "orphan.msg")); !os.IsNotExist(err) {
+		t.Errorf("message without state should be removed on load")
+	}
+
+	q.MinBackoff = 10 * time.Millisecond
+	q.Start()
+	defer q.Close()
+	waitFor(t, func() bool { return len(srv.Messages()) == 1 })
+	srv.ClearFailures()
+	waitFor(t, func() bool { return q.Len() == 0 })
+
+	// delivery to bob, then carol once greylisting is over
+	msgs := srv.Messages()
+	if len(msgs) != 2 || len(msgs[0].Envelope.Recipients) != 1 || msgs[0].Envelope.Recipients[0].Address != "bob@example.com" ||
+		len(msgs[1].Envelope.Recipients) != 1 || msgs[1].Envelope.Recipients[0].Address != "carol@example.com" {
+		t.Errorf("unexpected deliveries: %+v", msgs)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 1 {
+		t.Errorf("expected only the dead letter directory, got %v", files)
+	}
+}
+
+func TestQueueFailure(t *testing.T) {
+	dir := t.TempDir()
+	srv := pmailtest.NewServer()
+	defer srv.Close()
+	srv.FailRcpt("carol@example.com", &pmail.SMTPError{Code: 550, Enhanced: "5.1.1", Message: "No such user"})
+	srv.FailRcpt("dave@example.com", &pmail.SMTPError{Code: 450, Enhanced: "4.2.1", Message: "Try again later"})
+	sender := srv.Sender()
+	sender.PartialDelivery = true
+
+	q, err := pmail.NewQueue(dir, sender)
+	if err != nil {
+		t.Fatalf("failed to create queue: %s", err)
+	}
+	q.MinBackoff = 10 * time.Millisecond
+	var mu sync.Mutex
+	var failed []string
+	q.OnFailure = func(id string, env *pmail.Envelope, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		failed = append(failed, env.Addresses()...)
+	}
+	failedCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(failed)
+	}
+	q.Start()
+	defer q.Close()
+
+	m := testMail()
+	m.AddCc("carol@example.com")
+	m.AddCc("dave@example.com")
+	if err := m.Send(q); err != nil {
+		t.Fatalf("failed to queue: %s", err)
+	}
+	// carol fails first, then dave on a later attempt
+	waitFor(t, func() bool { return failedCount() == 1 })
+	srv.FailRcpt("dave@example.com", &pmail.SMTPError{Code: 550, Enhanced: "5.1.1", Message: "No such user"})
+	waitFor(t, func() bool { return q.Len() == 0 })
+
+	if n := len(srv.Messages()); n != 1 {
+		t.Errorf("expected 1 delivery, got %d", n)
+	}
+	mu.Lock()
+	if len(failed) != 2 || failed[0] != "carol@example.com" || failed[1] != "dave@example.com" {
+		t.Errorf("unexpected failed recipients %v", failed)
+	}
+	mu.Unlock()
+
+	// both failures are kept in the same dead letter
+	files, _ := filepath.Glob(filepath.Join(dir, "dead", "*.json"))
+	if len(files) != 1 {
+		t.Fatalf("expected 1 dead letter, got %v", files)
+	}
+	data, _ := os.ReadFile(files[0])
+	var dead struct {
+		Envelope *pmail.Envelope   `json:"envelope"`
+		Errors   map[string]string `json:"errors"`
+	}
+	if err := json.Unmarshal(data, &dead); err != nil || len(dead.Envelope.Recipients) != 2 || len(dead.Errors) != 2 {
+		t.Errorf("unexpected dead letter: %s", data)
+	}
+	if msgs, _ := filepath.Glob(filepath.Join(dir, "dead", "*.msg")); len(msgs) != 1 {
+		t.Errorf("expected the message in the dead letter directory, got %v", msgs)
+	}
+}
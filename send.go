@@ -1,21 +1,114 @@
 package pmail
 
-import "io"
+import (
+	"context"
+	"errors"
+	"io"
+)
 
 type Sender interface {
 	Send(from string, to []string, msg io.WriterTo) error
 }
 
-// Send sends the email using the given Sender.
+// ContextSender is implemented by senders supporting cancellation and deadlines through a
+// context. All senders provided by this package implement it.
+type ContextSender interface {
+	Sender
+	SendContext(ctx context.Context, env *Envelope, msg io.WriterTo) error
+}
+
+// RecipientsFromHeaders is implemented by senders that read the recipients from the message
+// headers rather than the envelope, such as "sendmail -t". The Bcc header is kept in the
+// message when sending through these.
+type RecipientsFromHeaders interface {
+	Sender
+	RecipientsFromHeaders() bool
+}
+
+// Send sends the email using the given Sender. The email is delivered to all To, Cc and
+// Bcc recipients, unless Envelope is set.
 func (m *Mail) Send(s Sender) error {
+	return m.SendContext(context.Background(), s)
+}
+
+// SendContext sends the email using the given Sender, which should implement ContextSender
+// for ctx to be able to interrupt the transmission.
+func (m *Mail) SendContext(ctx context.Context, s Sender) error {
 	if !m.IsValid() {
 		return ErrInvalidEmail
 	}
 
-	to := make([]string, 0, len(m.To))
-	for _, a := range m.To {
-		to = append(to, a.Address)
+	env := m.Envelope
+	if env == nil {
+		env = m.DefaultEnvelope()
+	}
+	return m.send(ctx, s, env)
+}
+
+// Deliver sends the email using the given ResultSender and returns the result for each
+// recipient of the envelope.
+func (m *Mail) Deliver(ctx context.Context, s ResultSender) (*SendResult, error) {
+	if !m.IsValid() {
+		return nil, ErrInvalidEmail
+	}
+
+	env := m.Envelope
+	if env == nil {
+		env = m.DefaultEnvelope()
+	}
+	return s.Deliver(ctx, env, m)
+}
+
+// SendEnvelope sends the email using the given Sender and envelope. This allows sending the
+// same message to different sets of recipients, or using a specific return path.
+func (m *Mail) SendEnvelope(s Sender, env *Envelope) error {
+	return m.send(context.Background(), s, env)
+}
+
+func (m *Mail) send(ctx context.Context, s Sender, env *Envelope) error {
+	if m.Body.IsEmpty() {
+		return ErrInvalidEmail
+	}
+	if len(env.Recipients) == 0 {
+		return errors.New("cannot send email: envelope has no recipients")
+	}
+
+	if !env.EightBitMIME && m.Body.Uses8Bit() {
+		e := *env
+		e.EightBitMIME = true
+		env = &e
 	}
 
-	return s.Send(m.From.Address, to, m)
+	var msg io.WriterTo = m
+	if rh, ok := s.(RecipientsFromHeaders); ok && rh.RecipientsFromHeaders() {
+		msg = &bccWriter{m}
+	}
+
+	return sendContext(ctx, s, env, msg)
+}
+
+// bccWriter writes a Mail including its Bcc header
+type bccWriter struct {
+	m *Mail
+}
+
+func (b *bccWriter) WriteTo(w io.Writer) (int64, error) {
+	return b.m.writeTo(w, true, false)
+}
+
+func (b *bccWriter) writeTo7Bit(w io.Writer) (int64, error) {
+	return b.m.writeTo(w, true, true)
+}
+
+// writer7Bit is implemented by messages able to write themselves with their 8bit parts
+// converted to a 7bit encoding, used when the server does not support 8BITMIME
+type writer7Bit interface {
+	writeTo7Bit(w io.Writer) (int64, error)
+}
+
+// writerToFunc allows using a function as an io.WriterTo
+type writerToFunc func(w io.Writer) (int64, error)
+
+func (f writerToFunc) WriteTo(w io.Writer) (int64, error) {
+	return f(w)
 }
@@ -0,0 +1,105 @@
+package pmail_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/KarpelesLab/pmail"
+	"github.com/KarpelesLab/pmail/pmailtest"
+)
+
+// headerRecorder is a Recorder for a sender reading recipients from the message headers
+type headerRecorder struct {
+	pmailtest.Recorder
+}
+
+func (h *headerRecorder) RecipientsFromHeaders() bool {
+	return true
+}
+
+func TestSendRecipients(t *testing.T) {
+	m := pmail.New()
+	m.SetFrom("test@example.com", "Test")
+	m.AddTo("bob@example.com", "Bob Test")
+	m.AddCc("alice@example.com")
+	m.AddCc("Bob@example.com")
+	m.AddBcc("hidden@example.com")
+	m.SetSubject("Hello")
+	m.SetBodyText("Hello")
+
+	s := &pmailtest.Recorder{}
+	if err := m.Send(s); err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	msg := s.Last()
+	expect := []string{"bob@example.com", "alice@example.com", "hidden@example.com"}
+	if msg.Envelope.From != "test@example.com" || !reflect.DeepEqual(msg.Envelope.Addresses(), expect) {
+		t.Errorf("unexpected envelope %s -> %v", msg.Envelope.From, msg.Envelope.Addresses())
+	}
+	if bytes.Contains(msg.Data, []byte("hidden@example.com")) {
+		t.Errorf("Bcc recipient leaked in message:\n%s", msg.Data)
+	}
+	if !bytes.Contains(msg.Data, []byte("Cc: <alice@example.com>, <Bob@example.com>\r\n")) {
+		t.Errorf("Cc header not found in message:\n%s", msg.Data)
+	}
+
+	hs := &headerRecorder{}
+	if err := m.Send(hs); err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	if msg := hs.Last(); !bytes.Contains(msg.Data, []byte("Bcc: <hidden@example.com>\r\n")) {
+		t.Errorf("Bcc header not found in message for header based sender:\n%s", msg.Data)
+	}
+
+	// emails without To recipients are valid
+	m = pmail.New()
+	m.SetFrom("test@example.com")
+	m.AddBcc("hidden@example.com")
+	m.SetBodyText("Hello")
+	if err := m.Send(s); err != nil {
+		t.Fatalf("failed to send to Bcc only: %s", err)
+	}
+	if addrs := s.Last().Envelope.Addresses(); len(addrs) != 1 || addrs[0] != "hidden@example.com" {
+		t.Errorf("unexpected recipients %v", addrs)
+	}
+}
+
+func TestSendEnvelope(t *testing.T) {
+	m := pmail.New()
+	m.SetFrom("test@example.com", "Test")
+	m.AddTo("bob@example.com", "Bob Test")
+	m.SetSubject("Hello")
+	m.SetBodyText("Hello")
+	m.Envelope = pmail.NewEnvelope("bounces+bob=example.com@example.com", "bob@example.com", "archive@example.com")
+
+	s := &pmailtest.Recorder{}
+	if err := m.Send(s); err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	msg := s.Last()
+	if msg.Envelope != m.Envelope {
+		t.Errorf("envelope was not passed to sender")
+	}
+	if msg.Envelope.From != "bounces+bob=example.com@example.com" || len(msg.Envelope.Recipients) != 2 {
+		t.Errorf("unexpected envelope %+v", msg.Envelope)
+	}
+	if !bytes.Contains(msg.Data, []byte("From: \"Test\" <test@example.com>\r\n")) {
+		t.Errorf("From header not found in message:\n%s", msg.Data)
+	}
+
+	// recipients are taken from the envelope only
+	m.To = nil
+	if err := m.Send(s); err != nil {
+		t.Errorf("failed to send to envelope recipients only: %s", err)
+	}
+	m.AddTo("bob@example.com")
+	m.Envelope = pmail.NewEnvelope("bounces@example.com")
+	if err := m.Send(s); err != pmail.ErrInvalidEmail {
+		t.Errorf("sending with an envelope without recipients should fail, got %v", err)
+	}
+
+	if env := pmail.NewEnvelope("test@example.com", "用户@例子.广告"); !env.SMTPUTF8 {
+		t.Errorf("SMTPUTF8 should be set for internationalized addresses")
+	}
+}
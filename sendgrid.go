@@ -1,38 +1,157 @@
 package pmail
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
+	"fmt"
+	"io"
+	"net/http"
 	"net/mail"
 	"strings"
 
 	sgmail "github.com/sendgrid/sendgrid-go/helpers/mail"
 )
 
-// AsSGMailV3 returns a sendgrid SGMailV3 object for this email
+// SendGridSender sends emails through the SendGrid v3 API
+type SendGridSender struct {
+	APIKey   string
+	Endpoint string       // defaults to https://api.sendgrid.com/v3/mail/send
+	Client   *http.Client // defaults to http.DefaultClient
+}
+
+// Send sends the email through the SendGrid API to the given recipients. from is ignored, the
+// sender being taken from the email.
+func (s *SendGridSender) Send(from string, to []string, msg io.WriterTo) error {
+	return s.SendContext(context.Background(), NewEnvelope(from, to...), msg)
+}
+
+// SendContext sends the email through the SendGrid API to the envelope recipients. Recipients
+// present in the To and Cc headers are shown as such, others are sent as Bcc. The return path
+// of the envelope is ignored.
+func (s *SendGridSender) SendContext(ctx context.Context, env *Envelope, msg io.WriterTo) error {
+	var m *Mail
+	switch v := msg.(type) {
+	case *Mail:
+		m = v
+	case *bccWriter:
+		m = v.m
+	default:
+		// parse message to convert it
+		buf := &bytes.Buffer{}
+		if _, err := msg.WriteTo(buf); err != nil {
+			return err
+		}
+		var err error
+		if m, err = Parse(buf); err != nil {
+			return err
+		}
+	}
+
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = "https://api.sendgrid.com/v3/mail/send"
+	}
+	sgm, err := m.sgMailV3(env)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(sgmail.GetRequestBody(sgm)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	cl := s.Client
+	if cl == nil {
+		cl = http.DefaultClient
+	}
+	resp, err := cl.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("sendgrid API returned error %s: %s", resp.Status, body)
+	}
+	return nil
+}
+
+// AsSGMailV3 returns a sendgrid SGMailV3 object for this email, or nil if the email has no
+// From address or one of its parts cannot be read
 func (m *Mail) AsSGMailV3() *sgmail.SGMailV3 {
-	pers := &sgmail.Personalization{
-		To:   makeSGEmails(m.To),
-		From: makeSGEmail(m.From),
-		CC:   makeSGEmails(m.Cc),
-		BCC:  makeSGEmails(m.Bcc),
+	res, err := m.sgMailV3(m.DefaultEnvelope())
+	if err != nil {
+		return nil
+	}
+	return res
+}
+
+// sgMailV3 returns a sendgrid SGMailV3 object delivering this email to the envelope recipients
+func (m *Mail) sgMailV3(env *Envelope) (*sgmail.SGMailV3, error) {
+	if m.From == nil {
+		return nil, ErrInvalidEmail
 	}
 
 	// From ReplyTo[] To[] Cc[] Bcc[] Body MessageId
 	res := &sgmail.SGMailV3{
 		From:             makeSGEmail(m.From),
 		Subject:          m.Body.Headers.Get("Subject"),
-		Personalizations: []*sgmail.Personalization{pers},
+		Personalizations: m.sgPersonalizations(env),
 	}
 
 	// res.Content && res.Attachments
-	scanSGPart(res, m.Body)
+	if err := scanSGPart(res, m.Body); err != nil {
+		return nil, err
+	}
 
-	return res
+	return res, nil
+}
+
+// sgPersonalizations returns the personalizations for the envelope recipients. SendGrid
+// requires a To recipient: if none of the To recipients is in the envelope, a Cc recipient is
+// used, or each blind recipient gets its own copy so they do not see each other.
+func (m *Mail) sgPersonalizations(env *Envelope) []*sgmail.Personalization {
+	to, cc := make(map[string]*mail.Address), make(map[string]*mail.Address)
+	for _, a := range m.To {
+		to[strings.ToLower(a.Address)] = a
+	}
+	for _, a := range m.Cc {
+		cc[strings.ToLower(a.Address)] = a
+	}
+
+	pers := &sgmail.Personalization{From: makeSGEmail(m.From)}
+	var bcc []*sgmail.Email
+	for _, rcpt := range env.Recipients {
+		addr := strings.ToLower(rcpt.Address)
+		if a, ok := to[addr]; ok {
+			pers.To = append(pers.To, makeSGEmail(a))
+		} else if a, ok := cc[addr]; ok {
+			pers.CC = append(pers.CC, makeSGEmail(a))
+		} else {
+			bcc = append(bcc, &sgmail.Email{Address: rcpt.Address})
+		}
+	}
+	if len(pers.To) == 0 && len(pers.CC) > 0 {
+		pers.To, pers.CC = pers.CC[:1], pers.CC[1:]
+	}
+	if len(pers.To) == 0 {
+		res := make([]*sgmail.Personalization, len(bcc))
+		for n, e := range bcc {
+			res[n] = &sgmail.Personalization{From: pers.From, To: []*sgmail.Email{e}}
+		}
+		return res
+	}
+	pers.BCC = bcc
+	return []*sgmail.Personalization{pers}
 }
 
 func scanSGPart(res *sgmail.SGMailV3, part *Part) error {
-	if strings.HasPrefix(part.Type, "text/") {
+	if strings.HasPrefix(part.Type, "text/") && !part.IsAttachment() {
 		data, err := part.readBody()
 		if err != nil {
 			return err
@@ -41,7 +160,9 @@ func scanSGPart(res *sgmail.SGMailV3, part *Part) error {
 		return nil
 	} else if part.IsContainer() {
 		for _, sub := range part.Children {
-			scanSGPart(res, sub)
+			if err := scanSGPart(res, sub); err != nil {
+				return err
+			}
 		}
 		return nil
 	} else if part.Data != nil || part.GetBody != nil {
@@ -51,9 +172,14 @@ func scanSGPart(res *sgmail.SGMailV3, part *Part) error {
 			return err
 		}
 		attach := &sgmail.Attachment{
-			Content: base64.StdEncoding.EncodeToString(data),
-			Type:    part.Type,
-			// TODO Filename, etc
+			Content:     base64.StdEncoding.EncodeToString(data),
+			Type:        part.Type,
+			Filename:    part.Filename(),
+			Disposition: "attachment",
+		}
+		if cid := part.ContentId(); cid != "" {
+			attach.Disposition = "inline"
+			attach.ContentID = cid
 		}
 		res.AddAttachment(attach)
 		return nil
@@ -68,14 +194,6 @@ func makeSGEmail(addr *mail.Address) *sgmail.Email {
 	}
 }
 
-func makeSGEmails(addrs []*mail.Address) []*sgmail.Email {
-	res := make([]*sgmail.Email, len(addrs))
-	for n, a := range addrs {
-		res[n] = makeSGEmail(a)
-	}
-	return res
-}
-
 func convertSGHeaders(h Header) map[string]string {
 	res := make(map[string]string)
 	for k, v := range h {
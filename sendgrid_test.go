@@ -0,0 +1,77 @@
+package pmail_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/KarpelesLab/pmail"
+)
+
+func TestSendGridSender(t *testing.T) {
+	var reqs []map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		var req map[string]any
+		json.Unmarshal(data, &req)
+		reqs = append(reqs, req)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+	s := &pmail.SendGridSender{APIKey: "key", Endpoint: srv.URL}
+
+	m := testMail()
+	m.AddCc("carol@example.com")
+	m.AddBcc("dave@example.com")
+	if err := m.Send(s); err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	// only the blind recipient, as when retrying a queued message
+	if err := m.SendEnvelope(s, pmail.NewEnvelope("test@example.com", "dave@example.com")); err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+
+	if len(reqs) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(reqs))
+	}
+	expect := []string{
+		`[{"bcc":[{"email":"dave@example.com"}],"cc":[{"email":"carol@example.com"}],"from":{"email":"test@example.com"},"to":[{"email":"bob@example.com"}]}]`,
+		`[{"from":{"email":"test@example.com"},"to":[{"email":"dave@example.com"}]}]`,
+	}
+	for n, req := range reqs {
+		pers, _ := json.Marshal(req["personalizations"])
+		if string(pers) != expect[n] {
+			t.Errorf("unexpected personalizations %s, expected %s", pers, expect[n])
+		}
+	}
+}
+
+func TestSendGridSenderErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("invalid email should not be sent")
+	}))
+	defer srv.Close()
+	s := &pmail.SendGridSender{APIKey: "key", Endpoint: srv.URL}
+
+	m := testMail()
+	m.From = nil
+	if err := m.SendEnvelope(s, pmail.NewEnvelope("test@example.com", "bob@example.com")); err != pmail.ErrInvalidEmail {
+		t.Errorf("email without From should fail, got %v", err)
+	}
+
+	m = testMail()
+	p, err := m.Attach("file.bin", "application/octet-stream", strings.NewReader("data"))
+	if err != nil {
+		t.Fatalf("failed to attach: %s", err)
+	}
+	readErr := errors.New("read failed")
+	p.Data = nil
+	p.GetBody = func() (io.ReadCloser, error) { return nil, readErr }
+	if err := m.Send(s); !errors.Is(err, readErr) {
+		t.Errorf("attachment error should be returned, got %v", err)
+	}
+}
@@ -1,17 +1,57 @@
 package pmail
 
 import (
+	"context"
 	"io"
 	"os/exec"
 )
 
+// SendmailSender invokes sendmail with the envelope sender and recipients as arguments
 type SendmailSender string
 
+// SendmailTSender invokes sendmail with the -t option, letting it read recipients from the
+// message headers. When using this sender, Mail.Send keeps the Bcc header in the message
+// so sendmail can deliver to these recipients (sendmail removes it before transmission).
+type SendmailTSender string
+
 var Sendmail Sender = SendmailSender("/usr/sbin/sendmail")
 
-// Send invokes sendmail to send the specified message. from and to will be ignored
+// Send invokes sendmail to send the specified message
 func (s SendmailSender) Send(from string, to []string, msg io.WriterTo) error {
-	cmd := exec.Command(string(s))
+	return s.SendContext(context.Background(), NewEnvelope(from, to...), msg)
+}
+
+// SendEnvelope invokes sendmail to send the specified message. Only the envelope sender and
+// recipient addresses are used.
+func (s SendmailSender) SendEnvelope(env *Envelope, msg io.WriterTo) error {
+	return s.SendContext(context.Background(), env, msg)
+}
+
+// SendContext invokes sendmail to send the specified message. The process is killed if ctx
+// is canceled or expires before it completes.
+func (s SendmailSender) SendContext(ctx context.Context, env *Envelope, msg io.WriterTo) error {
+	args := []string{"-i", "-f", sendmailFrom(env.From), "--"}
+	return runSendmail(ctx, string(s), append(args, env.Addresses()...), msg)
+}
+
+// Send invokes sendmail -t to send the specified message. to will be ignored
+func (s SendmailTSender) Send(from string, to []string, msg io.WriterTo) error {
+	return s.SendContext(context.Background(), NewEnvelope(from, to...), msg)
+}
+
+// SendContext invokes sendmail -t to send the specified message. Recipients will be ignored.
+// The process is killed if ctx is canceled or expires before it completes.
+func (s SendmailTSender) SendContext(ctx context.Context, env *Envelope, msg io.WriterTo) error {
+	return runSendmail(ctx, string(s), []string{"-t", "-i", "-f", sendmailFrom(env.From)}, msg)
+}
+
+// RecipientsFromHeaders returns true as sendmail -t reads recipients from the message
+func (s SendmailTSender) RecipientsFromHeaders() bool {
+	return true
+}
+
+func runSendmail(ctx context.Context, path string, args []string, msg io.WriterTo) error {
+	cmd := exec.CommandContext(ctx, path, args...)
 	writer, err := cmd.StdinPipe()
 	if err != nil {
 		return err
@@ -25,7 +65,23 @@ func (s SendmailSender) Send(from string, to []string, msg io.WriterTo) error {
 	if err != nil {
 		cmd.Process.Kill()
 		cmd.Wait()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		return err
 	}
-	return cmd.Wait()
+	writer.Close()
+	err = cmd.Wait()
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// sendmailFrom returns the value to pass as -f, using <> for the null sender
+func sendmailFrom(from string) string {
+	if from == "" {
+		return "<>"
+	}
+	return from
 }
@@ -0,0 +1,74 @@
+package pmail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"io"
+	"mime"
+)
+
+// SignSMIME signs the content of the email with S/MIME (RFC 8551). The body is replaced with a
+// multipart/signed part holding the content and a detached signature made with key, whose
+// certificate is cert. Intermediate certificates can be included with chain. The content
+// cannot be modified after signing.
+func (m *Mail) SignSMIME(cert *x509.Certificate, key crypto.Signer, chain ...*x509.Certificate) error {
+	content, err := m.contentEntity()
+	if err != nil {
+		return err
+	}
+	sig, err := cmsSignDetached(content.raw, cert, key, chain)
+	if err != nil {
+		return err
+	}
+
+	sigPart := smimePart("application/pkcs7-signature", "", "smime.p7s", sig)
+	m.Body.Children = []*Part{signedPart(content, "application/pkcs7-signature", "sha-256", sigPart)}
+	return nil
+}
+
+// EncryptSMIME encrypts the content of the email with S/MIME (RFC 8551) for the given
+// recipients, which must have RSA certificates. Include the sender's certificate to be able to
+// read the email later. The email can be signed before being encrypted.
+func (m *Mail) EncryptSMIME(recipients ...*x509.Certificate) error {
+	content, err := m.contentEntity()
+	if err != nil {
+		return err
+	}
+	data, err := cmsEncrypt(content.raw, recipients)
+	if err != nil {
+		return err
+	}
+	m.Body.Children = []*Part{smimePart("application/pkcs7-mime", "enveloped-data", "smime.p7m", data)}
+	return nil
+}
+
+// contentEntity renders the content of the email (everything but the message headers) as a
+// MIME entity, converted to 7bit so it won't be modified in transit
+func (m *Mail) contentEntity() (*Part, error) {
+	if len(m.Body.Children) != 1 || m.Body.IsEmpty() {
+		return nil, ErrPartHasNoBody
+	}
+	c := m.Body.Children[0]
+	c.Convert7Bit()
+
+	buf := &bytes.Buffer{}
+	if _, err := c.WriteTo(buf); err != nil {
+		return nil, err
+	}
+	return &Part{Type: c.Type, Headers: make(Header), raw: buf.Bytes()}, nil
+}
+
+// smimePart returns a base64 encoded part holding CMS data
+func smimePart(typ, smimeType, filename string, data []byte) *Part {
+	params := map[string]string{"name": filename}
+	if smimeType != "" {
+		params["smime-type"] = smimeType
+	}
+	p := NewPart(typ)
+	p.Headers.Set("Content-Type", mime.FormatMediaType(typ, params))
+	p.Headers.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	p.Data = io.NopCloser(bytes.NewReader(data))
+	p.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(data)), nil }
+	return p
+}
@@ -0,0 +1,185 @@
+package pmail_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/pmail"
+)
+
+func testCertificate(t *testing.T, key crypto.Signer) *x509.Certificate {
+	tpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(42),
+		Subject:        pkix.Name{CommonName: "test@example.com"},
+		EmailAddresses: []string{"test@example.com"},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, key.Public(), key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %s", err)
+	}
+	return cert
+}
+
+// smimeData returns the decoded content of the first part of the given type
+func smimeData(t *testing.T, msg []byte, typ string) []byte {
+	t.Helper()
+	m, err := pmail.Parse(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	p := m.Body.FindType(typ, true)
+	if p == nil {
+		t.Fatalf("no %s part found in:\n%s", typ, msg)
+	}
+	data, err := io.ReadAll(p.Data)
+	if err != nil {
+		t.Fatalf("failed to read part: %s", err)
+	}
+	return data
+}
+
+func TestSignSMIME(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	cert := testCertificate(t, key)
+
+	m := testMail()
+	if err := m.SignSMIME(cert, key); err != nil {
+		t.Fatalf("failed to sign: %s", err)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := m.WriteTo(buf); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	msg := buf.Bytes()
+	if !bytes.Contains(msg, []byte(`Content-Type: multipart/signed; boundary=`)) || !bytes.Contains(msg, []byte(`protocol="application/pkcs7-signature"`)) {
+		t.Fatalf("unexpected message:\n%s", msg)
+	}
+
+	// signed content is between the first boundary and the next one
+	m2, _ := pmail.Parse(bytes.NewReader(msg))
+	delim := "\r\n--" + m2.Body.Children[0].Boundary
+	_, content, _ := strings.Cut(string(msg), delim+"\r\n")
+	content, _, _ = strings.Cut(content, delim)
+
+	var ci struct {
+		Type    asn1.ObjectIdentifier
+		Content asn1.RawValue `asn1:"explicit,tag:0"`
+	}
+	var sd struct {
+		Version          int
+		DigestAlgorithms asn1.RawValue
+		EncapContentInfo asn1.RawValue
+		Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+		SignerInfos      []struct {
+			Version            int
+			SID                asn1.RawValue
+			DigestAlgorithm    asn1.RawValue
+			SignedAttrs        asn1.RawValue
+			SignatureAlgorithm asn1.RawValue
+			Signature          []byte
+		} `asn1:"set"`
+	}
+	if _, err := asn1.Unmarshal(smimeData(t, msg, "application/pkcs7-signature"), &ci); err != nil {
+		t.Fatalf("invalid signature: %s", err)
+	}
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		t.Fatalf("invalid signed data: %s", err)
+	}
+	if len(sd.SignerInfos) != 1 || !bytes.Contains(sd.Certificates.Bytes, cert.Raw) {
+		t.Fatalf("unexpected signed data: %+v", sd)
+	}
+	si := sd.SignerInfos[0]
+	digest := sha256.Sum256([]byte(content))
+	if !bytes.Contains(si.SignedAttrs.Bytes, digest[:]) {
+		t.Errorf("message digest does not match signed content")
+	}
+	set := append([]byte{0x31}, si.SignedAttrs.FullBytes[1:]...)
+	h := sha256.Sum256(set)
+	if !ecdsa.VerifyASN1(&key.PublicKey, h[:], si.Signature) {
+		t.Errorf("signature does not verify")
+	}
+}
+
+func TestEncryptSMIME(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	cert := testCertificate(t, key)
+
+	m := testMail()
+	if err := m.EncryptSMIME(cert); err != nil {
+		t.Fatalf("failed to encrypt: %s", err)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := m.WriteTo(buf); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	msg := buf.Bytes()
+	if !bytes.Contains(msg, []byte("Content-Type: application/pkcs7-mime;")) || !bytes.Contains(msg, []byte("smime-type=enveloped-data")) || bytes.Contains(msg, []byte("Hello")) {
+		t.Fatalf("unexpected message:\n%s", msg)
+	}
+
+	var ci struct {
+		Type    asn1.ObjectIdentifier
+		Content asn1.RawValue `asn1:"explicit,tag:0"`
+	}
+	var ed struct {
+		Version        int
+		RecipientInfos []struct {
+			Version      int
+			RID          asn1.RawValue
+			Algorithm    asn1.RawValue
+			EncryptedKey []byte
+		} `asn1:"set"`
+		EncryptedContentInfo struct {
+			Type      asn1.ObjectIdentifier
+			Algorithm struct {
+				Algorithm asn1.ObjectIdentifier
+				IV        []byte
+			}
+			Data asn1.RawValue `asn1:"tag:0"`
+		}
+	}
+	if _, err := asn1.Unmarshal(smimeData(t, msg, "application/pkcs7-mime"), &ci); err != nil {
+		t.Fatalf("invalid content: %s", err)
+	}
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+		t.Fatalf("invalid enveloped data: %s", err)
+	}
+	if len(ed.RecipientInfos) != 1 {
+		t.Fatalf("expected 1 recipient, got %d", len(ed.RecipientInfos))
+	}
+	cek, err := rsa.DecryptPKCS1v15(rand.Reader, key, ed.RecipientInfos[0].EncryptedKey)
+	if err != nil {
+		t.Fatalf("failed to decrypt key: %s", err)
+	}
+	block, _ := aes.NewCipher(cek)
+	data := ed.EncryptedContentInfo.Data.Bytes
+	cipher.NewCBCDecrypter(block, ed.EncryptedContentInfo.Algorithm.IV).CryptBlocks(data, data)
+	data = data[:len(data)-int(data[len(data)-1])]
+	if !bytes.HasPrefix(data, []byte("Content-Transfer-Encoding: quoted-printable\r\nContent-Type: text/plain")) || !bytes.Contains(data, []byte("Hello")) {
+		t.Errorf("unexpected decrypted content:\n%s", data)
+	}
+}
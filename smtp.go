@@ -1,78 +1,373 @@
 package pmail
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"time"
 )
 
 // RelaySender sends emails to a relaying server
+//
+// When the server advertises the SIZE extension (RFC 1870), each message is fully rendered in
+// memory before the transaction starts, in order to declare its size and to avoid sending a
+// message the server would refuse. Otherwise messages are streamed to the server.
 type RelaySender struct {
 	Host       string
 	Port       int
 	Auth       smtp.Auth
 	TLSConfig  *tls.Config
-	RequireTLS bool
+	LocalName  string  // name sent in EHLO, defaults to localhost
+	RequireTLS bool    // fail if the connection cannot be secured with TLS
+	TLSMode    TLSMode // how TLS is established, defaults to implicit TLS on port 465 and STARTTLS otherwise
+
+	// PartialDelivery allows sending the email to the accepted recipients when some others
+	// are rejected. By default the email is only sent if all recipients are accepted.
+	PartialDelivery bool
+
+	DialTimeout    time.Duration // timeout for establishing the connection, defaults to 30 seconds
+	CommandTimeout time.Duration // timeout for each SMTP command, defaults to 5 minutes
+	DataTimeout    time.Duration // timeout for transmitting the message, defaults to 10 minutes
 }
 
+// TLSMode selects how RelaySender establishes TLS
+type TLSMode int
+
+const (
+	TLSAuto     TLSMode = iota // implicit TLS on port 465, STARTTLS otherwise
+	TLSImplicit                // connect using TLS directly (SMTPS)
+	TLSStartTLS                // use STARTTLS if the server supports it
+)
+
+const (
+	defaultDialTimeout    = 30 * time.Second
+	defaultCommandTimeout = 5 * time.Minute  // RFC 5321 4.5.3.2.2 - 4.5.3.2.4
+	defaultDataTimeout    = 10 * time.Minute // RFC 5321 4.5.3.2.6
+)
+
+// NewDialer returns a RelaySender authenticating with the given credentials, using the best
+// mechanism supported by the server (see PasswordAuth)
 func NewDialer(host string, port int, username, password string) *RelaySender {
-	return &RelaySender{Host: host, Port: port, Auth: smtp.PlainAuth("", username, password, host)}
+	return &RelaySender{Host: host, Port: port, Auth: PasswordAuth(username, password, host)}
 }
 
 // Send connects to the relay server and sends the email
 func (r *RelaySender) Send(from string, to []string, msg io.WriterTo) error {
-	cl, err := smtp.Dial(fmt.Sprintf("%s:%d", r.Host, r.Port))
+	return r.SendEnvelope(NewEnvelope(from, to...), msg)
+}
+
+// SendEnvelope connects to the relay server and sends the email using the given envelope
+func (r *RelaySender) SendEnvelope(env *Envelope, msg io.WriterTo) error {
+	return r.SendContext(context.Background(), env, msg)
+}
+
+// SendContext connects to the relay server and sends the email using the given envelope. If
+// ctx is canceled or expires, the connection is closed and the context error is returned.
+// Errors returned by the server are of type *SMTPError.
+func (r *RelaySender) SendContext(ctx context.Context, env *Envelope, msg io.WriterTo) error {
+	res, err := r.Deliver(ctx, env, msg)
 	if err != nil {
 		return err
 	}
-	defer cl.Close()
+	return res.Err()
+}
+
+// Deliver connects to the relay server and sends the email, returning the result for each
+// recipient. Unless PartialDelivery is set, the email is not sent if any recipient is rejected.
+func (r *RelaySender) Deliver(ctx context.Context, env *Envelope, msg io.WriterTo) (*SendResult, error) {
+	res, err := r.deliver(ctx, env, msg)
+	if err != nil && ctx.Err() != nil {
+		return res, ctx.Err()
+	}
+	return res, err
+}
 
-	if stls, _ := cl.Extension("STARTTLS"); stls {
-		tlscfg := &tls.Config{ServerName: r.Host}
-		if r.TLSConfig != nil {
-			tlscfg = r.TLSConfig
-		}
-		err = cl.StartTLS(tlscfg)
-		if err != nil {
-			return err
+func (r *RelaySender) deliver(ctx context.Context, env *Envelope, msg io.WriterTo) (*SendResult, error) {
+	cl, err := r.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cl.close()
+	defer watchContext(ctx, cl.conn)()
+
+	res, err := sendSMTPEnvelope(cl, env, msg, r.PartialDelivery)
+	if err != nil {
+		return res, err
+	}
+
+	cl.quit()
+	return res, nil
+}
+
+// dial connects to the relay server and returns a session ready to send emails, with TLS
+// and authentication already established.
+func (r *RelaySender) dial(ctx context.Context) (*smtpClient, error) {
+	return r.dialAddr(ctx, net.JoinHostPort(r.Host, strconv.Itoa(r.Port)))
+}
+
+// dialAddr is like dial but connects to the given address, Host being still used for TLS
+// verification and authentication
+func (r *RelaySender) dialAddr(ctx context.Context, addr string) (*smtpClient, error) {
+	dialer := &net.Dialer{Timeout: timeoutOrDefault(r.DialTimeout, defaultDialTimeout)}
+
+	var conn net.Conn
+	var err error
+	if r.isImplicitTLS() {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: r.tlsConfig()}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, smtpErr(PhaseConnect, err)
+	}
+	defer watchContext(ctx, conn)()
+
+	cl, err := newSMTPClient(conn, r.Host, timeoutOrDefault(r.CommandTimeout, defaultCommandTimeout))
+	if err != nil {
+		conn.Close()
+		return nil, smtpErr(PhaseConnect, err)
+	}
+	cl.dataTimeout = timeoutOrDefault(r.DataTimeout, defaultDataTimeout)
+
+	if err = r.setup(cl); err != nil {
+		cl.close()
+		return nil, err
+	}
+	return cl, nil
+}
+
+// setup runs EHLO, STARTTLS if needed, and authentication on a new session
+func (r *RelaySender) setup(cl *smtpClient) error {
+	if err := cl.hello(r.localName()); err != nil {
+		return smtpErr(PhaseConnect, err)
+	}
+
+	if !cl.isTLS {
+		if stls, _ := cl.extension("STARTTLS"); stls {
+			if err := cl.startTLS(r.tlsConfig()); err != nil {
+				return smtpErr(PhaseConnect, err)
+			}
+			if err := cl.hello(r.localName()); err != nil {
+				return smtpErr(PhaseConnect, err)
+			}
+		} else if r.RequireTLS {
+			return smtpErr(PhaseConnect, fmt.Errorf("cannot send email: configuration requires TLS but server %s does not support it", r.Host))
 		}
-	} else if r.RequireTLS {
-		return fmt.Errorf("cannot send email: configuration requires TLS but server %s does not support it", r.Host)
 	}
 
 	if r.Auth != nil {
-		err = cl.Auth(r.Auth)
-		if err != nil {
-			return err
+		if ok, _ := cl.extension("AUTH"); !ok {
+			return smtpErr(PhaseAuth, fmt.Errorf("cannot send email: server %s doesn't support AUTH", r.Host))
+		}
+		if err := cl.authenticate(r.Auth); err != nil {
+			return smtpErr(PhaseAuth, err)
 		}
 	}
+	return nil
+}
 
-	err = cl.Mail(from)
+func (r *RelaySender) localName() string {
+	if r.LocalName == "" {
+		return "localhost"
+	}
+	return r.LocalName
+}
+
+func (r *RelaySender) isImplicitTLS() bool {
+	switch r.TLSMode {
+	case TLSImplicit:
+		return true
+	case TLSStartTLS:
+		return false
+	}
+	return r.Port == 465
+}
+
+// tlsConfig returns the TLS configuration to use, making sure the server name is set
+func (r *RelaySender) tlsConfig() *tls.Config {
+	if r.TLSConfig == nil {
+		return &tls.Config{ServerName: r.Host}
+	}
+	if r.TLSConfig.ServerName == "" && !r.TLSConfig.InsecureSkipVerify {
+		cfg := r.TLSConfig.Clone()
+		cfg.ServerName = r.Host
+		return cfg
+	}
+	return r.TLSConfig
+}
+
+func timeoutOrDefault(t, def time.Duration) time.Duration {
+	if t == 0 {
+		return def
+	}
+	return t
+}
+
+// sendSMTPEnvelope runs the MAIL, RCPT and DATA commands on an established session. All
+// recipients are tried, and the message is sent only if all were accepted, or at least one
+// was accepted if partial is true. Accepted recipients are reported as rejected if the message
+// was not transmitted. Commands are pipelined and the message is sent with BDAT when the
+// server supports it.
+func sendSMTPEnvelope(cl *smtpClient, env *Envelope, msg io.WriterTo, partial bool) (*SendResult, error) {
+	res := &SendResult{}
+	if len(env.Recipients) == 0 {
+		return res, smtpErr(PhaseRcpt, errors.New("no recipients"))
+	}
+
+	if err := checkArg("sender", env.From); err != nil {
+		return res, smtpErr(PhaseMail, err)
+	}
+	var rcpts []*Recipient
+	for _, rcpt := range env.Recipients {
+		if err := checkArg("recipient", rcpt.Address); err != nil {
+			e := smtpErr(PhaseRcpt, err)
+			e.Recipient = rcpt.Address
+			res.Rejected = append(res.Rejected, e)
+			continue
+		}
+		rcpts = append(rcpts, rcpt)
+	}
+	if len(rcpts) == 0 {
+		return res, res.Err()
+	}
+
+	params, msg, err := mailParams(cl, env, msg)
 	if err != nil {
-		return err
+		return res, smtpErr(PhaseMail, err)
+	}
+
+	cmds := []string{mailCommand(env.From, params)}
+	codes := []int{250}
+	dsn, _ := cl.extension("DSN")
+	for _, rcpt := range rcpts {
+		var params []string
+		if dsn {
+			params = dsnRcptParams(rcpt)
+		}
+		cmds = append(cmds, rcptCommand(rcpt.Address, params))
+		codes = append(codes, 25)
+	}
+
+	var errs []error
+	if ok, _ := cl.extension("PIPELINING"); ok {
+		errs = cl.pipeline(cmds, codes)
+	} else {
+		errs = make([]error, len(cmds))
+		for n, cmd := range cmds {
+			_, _, errs[n] = cl.cmd(codes[n], "%s", cmd)
+			var tpErr *textproto.Error
+			if errs[n] != nil && (n == 0 || !errors.As(errs[n], &tpErr)) {
+				// MAIL failed or connection is broken, do not send other commands
+				break
+			}
+		}
+	}
+
+	if errs[0] != nil {
+		return res, smtpErr(PhaseMail, errs[0])
 	}
-	for _, t := range to {
-		err = cl.Rcpt(t)
-		if err != nil {
-			return err
+	for n, rcpt := range rcpts {
+		if err := errs[n+1]; err != nil {
+			e := smtpErr(PhaseRcpt, err)
+			if e.Code == 0 {
+				// not a server reply, connection is likely broken
+				return res, e
+			}
+			e.Recipient = rcpt.Address
+			res.Rejected = append(res.Rejected, e)
+			continue
 		}
+		res.Accepted = append(res.Accepted, rcpt.Address)
+	}
+	if len(res.Accepted) == 0 {
+		return res, res.Err()
+	}
+	if len(res.Rejected) > 0 && !partial {
+		res.notSent(&SMTPError{Phase: PhaseRcpt, Message: ErrNotSent.Error(), Err: ErrNotSent})
+		return res, res.Err()
 	}
 
 	// send data
-	wr, err := cl.Data()
-	if err != nil {
-		return err
+	cl.accepted = len(res.Accepted)
+	if ok, _ := cl.extension("CHUNKING"); ok {
+		err = cl.bdat(msg)
+	} else {
+		err = cl.data(msg)
 	}
-	_, err = msg.WriteTo(wr)
 	if err != nil {
-		return err
+		e := smtpErr(PhaseData, err)
+		res.notSent(e)
+		return res, e
 	}
-	err = wr.Close()
-	if err != nil {
-		return err
+	if cl.lmtp {
+		return lmtpResult(res, cl.rcptErrs)
 	}
+	return res, nil
+}
 
-	cl.Quit()
-	return nil
+// lmtpResult updates res with the per-recipient replies received after the message was
+// transmitted over LMTP. An error is returned only if no recipient accepted the message.
+func lmtpResult(res *SendResult, errs []error) (*SendResult, error) {
+	accepted := res.Accepted
+	res.Accepted = nil
+	for n, addr := range accepted {
+		if err := errs[n]; err != nil {
+			e := smtpErr(PhaseData, err)
+			e.Recipient = addr
+			res.Rejected = append(res.Rejected, e)
+			continue
+		}
+		res.Accepted = append(res.Accepted, addr)
+	}
+	if len(res.Accepted) == 0 {
+		return res, res.Err()
+	}
+	return res, nil
+}
+
+// mailParams returns the MAIL FROM parameters for the envelope, based on what the server
+// supports. The returned message is the one to send, which may have been converted to 7bit or
+// rendered in memory to compute its size.
+func mailParams(cl *smtpClient, env *Envelope, msg io.WriterTo) ([]string, io.WriterTo, error) {
+	var params []string
+	if env.EightBitMIME {
+		if ok, _ := cl.extension("8BITMIME"); ok {
+			params = append(params, "BODY=8BITMIME")
+		} else if c, ok := msg.(writer7Bit); ok {
+			msg = writerToFunc(c.writeTo7Bit)
+		} else {
+			return nil, nil, errors.New("cannot send email: message contains 8bit data but server does not support 8BITMIME")
+		}
+	}
+	if env.SMTPUTF8 || !isASCII(env.From) || !isASCII(env.Addresses()...) {
+		if ok, _ := cl.extension("SMTPUTF8"); !ok {
+			return nil, nil, errors.New("cannot send email: internationalized addresses require SMTPUTF8 but server does not support it")
+		}
+		params = append(params, "SMTPUTF8")
+	}
+	if ok, _ := cl.extension("DSN"); ok {
+		params = append(params, dsnMailParams(env)...)
+	}
+	if ok, v := cl.extension("SIZE"); ok {
+		// render the message in memory to declare its size, and avoid sending it if it is too
+		// large, see RelaySender
+		buf := &bytes.Buffer{}
+		if _, err := msg.WriteTo(buf); err != nil {
+			return nil, nil, err
+		}
+		if max, _ := strconv.ParseInt(v, 10, 64); max > 0 && int64(buf.Len()) > max {
+			return nil, nil, &SMTPError{Phase: PhaseMail, Code: 552, Enhanced: "5.3.4", Message: fmt.Sprintf("message size %d exceeds server limit of %d bytes", buf.Len(), max)}
+		}
+		params = append(params, "SIZE="+strconv.Itoa(buf.Len()))
+		msg = bytes.NewReader(buf.Bytes())
+	}
+	return params, msg, nil
 }
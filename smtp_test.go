@@ -0,0 +1,516 @@
+package pmail_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/pmail"
+)
+
+// fakeSMTP is a minimal SMTP server used to test the client side
+type fakeSMTP struct {
+	l    net.Listener
+	ext  []string          // extensions advertised in EHLO
+	tls  *tls.Config       // enables STARTTLS if set
+	fail map[string]string // command prefix → error reply
+	once map[string]string // same as fail, but only for the first matching command
+	mu   sync.Mutex
+	log  []string // commands received
+	msgs []string // messages received
+	conn int      // number of connections
+}
+
+// newFakeSMTP returns a new server listening on 127.0.0.1. tlsMode can be "starttls" or
+// "implicit" to enable TLS. start must be called once the server is configured.
+func newFakeSMTP(t *testing.T, tlsMode string) *fakeSMTP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	s := &fakeSMTP{fail: make(map[string]string), once: make(map[string]string)}
+	switch tlsMode {
+	case "starttls":
+		s.tls = testTLSConfig(t)
+	case "implicit":
+		s.tls = testTLSConfig(t)
+		l = tls.NewListener(l, s.tls)
+	}
+	s.l = l
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *fakeSMTP) start() *fakeSMTP {
+	go s.serve()
+	return s
+}
+
+func (s *fakeSMTP) port() int {
+	return s.l.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeSMTP) commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.log...)
+}
+
+func (s *fakeSMTP) serve() {
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conn++
+		s.mu.Unlock()
+		go s.handle(c)
+	}
+}
+
+func (s *fakeSMTP) handle(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	fmt.Fprintf(c, "220 localhost ready\r\n")
+	_, isTLS := c.(*tls.Conn)
+	chunks := &strings.Builder{} // data received through BDAT
+
+	for {
+		ln, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		ln = strings.TrimRight(ln, "\r\n")
+		s.mu.Lock()
+		s.log = append(s.log, ln)
+		reply, fail := "", false
+		for k, v := range s.fail {
+			if strings.HasPrefix(ln, k) {
+				reply, fail = v, true
+			}
+		}
+		for k, v := range s.once {
+			if strings.HasPrefix(ln, k) {
+				reply, fail = v, true
+				delete(s.once, k)
+			}
+		}
+		s.mu.Unlock()
+		if fail {
+			fmt.Fprintf(c, "%s\r\n", reply)
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(ln, "EHLO"):
+			ext := s.ext
+			if s.tls != nil && !isTLS {
+				ext = append([]string{"STARTTLS"}, ext...)
+			}
+			fmt.Fprintf(c, "250-localhost\r\n")
+			for _, e := range ext {
+				fmt.Fprintf(c, "250-%s\r\n", e)
+			}
+			fmt.Fprintf(c, "250 HELP\r\n")
+		case ln == "STARTTLS":
+			fmt.Fprintf(c, "220 go ahead\r\n")
+			tc := tls.Server(c, s.tls)
+			if tc.Handshake() != nil {
+				return
+			}
+			c, r, isTLS = tc, bufio.NewReader(tc), true
+		case ln == "AUTH LOGIN":
+			for _, prompt := range []string{"VXNlcm5hbWU6", "UGFzc3dvcmQ6"} {
+				fmt.Fprintf(c, "334 %s\r\n", prompt)
+				resp, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				s.mu.Lock()
+				s.log = append(s.log, strings.TrimRight(resp, "\r\n"))
+				s.mu.Unlock()
+			}
+			fmt.Fprintf(c, "235 2.7.0 authenticated\r\n")
+		case strings.HasPrefix(ln, "AUTH"):
+			fmt.Fprintf(c, "235 2.7.0 authenticated\r\n")
+		case ln == "DATA":
+			fmt.Fprintf(c, "354 go ahead\r\n")
+			buf := &strings.Builder{}
+			for {
+				ln, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if ln == ".\r\n" {
+					break
+				}
+				buf.WriteString(strings.TrimPrefix(ln, "."))
+			}
+			s.mu.Lock()
+			s.msgs = append(s.msgs, buf.String())
+			s.mu.Unlock()
+			fmt.Fprintf(c, "250 2.0.0 queued\r\n")
+		case strings.HasPrefix(ln, "BDAT "):
+			f := strings.Fields(ln)
+			n, _ := strconv.Atoi(f[1])
+			buf := make([]byte, n)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return
+			}
+			chunks.Write(buf)
+			if len(f) > 2 && f[2] == "LAST" {
+				s.mu.Lock()
+				s.msgs = append(s.msgs, chunks.String())
+				s.mu.Unlock()
+				chunks.Reset()
+			}
+			fmt.Fprintf(c, "250 2.0.0 %d bytes received\r\n", n)
+		case ln == "QUIT":
+			fmt.Fprintf(c, "221 bye\r\n")
+			return
+		default:
+			fmt.Fprintf(c, "250 2.0.0 ok\r\n")
+		}
+	}
+}
+
+// testTLSConfig returns a server TLS configuration using a self-signed certificate for 127.0.0.1
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func testMail() *pmail.Mail {
+	m := pmail.New()
+	m.SetFrom("test@example.com")
+	m.AddTo("bob@example.com")
+	m.SetBodyText("Hello")
+	return m
+}
+
+func TestRelaySenderContext(t *testing.T) {
+	// server accepting connections but never answering
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	m := testMail()
+	r := &pmail.RelaySender{Host: "127.0.0.1", Port: l.Addr().(*net.TCPAddr).Port}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = m.SendContext(ctx, r)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("send took too long to be interrupted")
+	}
+
+	r.CommandTimeout = 100 * time.Millisecond
+	var nerr net.Error
+	if err := m.Send(r); !errors.As(err, &nerr) || !nerr.Timeout() {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+}
+
+func TestRelaySenderTLS(t *testing.T) {
+	for _, implicit := range []bool{false, true} {
+		mode := "starttls"
+		if implicit {
+			mode = "implicit"
+		}
+		srv := newFakeSMTP(t, mode).start()
+
+		r := &pmail.RelaySender{
+			Host:       "127.0.0.1",
+			Port:       srv.port(),
+			TLSConfig:  &tls.Config{InsecureSkipVerify: true},
+			RequireTLS: true,
+			TLSMode:    pmail.TLSStartTLS,
+		}
+		if implicit {
+			r.TLSMode = pmail.TLSImplicit
+		}
+		if err := testMail().Send(r); err != nil {
+			t.Errorf("failed to send (implicit=%v): %s", implicit, err)
+			continue
+		}
+		cmds := srv.commands()
+		if hasStartTLS := len(cmds) > 1 && cmds[1] == "STARTTLS"; hasStartTLS == implicit {
+			t.Errorf("unexpected commands (implicit=%v): %v", implicit, cmds)
+		}
+	}
+
+	// RequireTLS must fail when the server does not offer STARTTLS
+	srv := newFakeSMTP(t, "").start()
+	r := &pmail.RelaySender{Host: "127.0.0.1", Port: srv.port(), RequireTLS: true}
+	var se *pmail.SMTPError
+	if err := testMail().Send(r); !errors.As(err, &se) || !se.Permanent() || se.Temporary() {
+		t.Errorf("RequireTLS should fail permanently without STARTTLS, got %v", err)
+	}
+}
+
+func TestRelaySenderErrors(t *testing.T) {
+	srv := newFakeSMTP(t, "")
+	srv.fail["RCPT TO:<bad@example.com>"] = "550 5.1.1 User unknown"
+	srv.fail["RCPT TO:<later@example.com>"] = "451 4.3.0 Try again later"
+	srv.start()
+
+	m := testMail()
+	m.AddTo("bad@example.com")
+	m.AddCc("later@example.com")
+	r := &pmail.RelaySender{Host: "127.0.0.1", Port: srv.port()}
+
+	res, err := m.Deliver(context.Background(), r)
+	var re *pmail.RecipientsError
+	if !errors.As(err, &re) || len(re.Rejected) != 3 || re.Permanent() || !re.Temporary() {
+		t.Fatalf("delivery should fail with a temporary error when recipients are rejected, got %v", err)
+	}
+	// the message was not sent, so the accepted recipient is reported as temporarily rejected
+	if len(res.Accepted) != 0 || len(res.Rejected) != 3 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	if e := res.Rejected[2]; e.Recipient != "bob@example.com" || !errors.Is(e, pmail.ErrNotSent) || !e.Temporary() {
+		t.Errorf("unexpected error: %+v", e)
+	}
+	e := res.Rejected[0]
+	if e.Phase != pmail.PhaseRcpt || e.Code != 550 || e.Enhanced != "5.1.1" || e.Recipient != "bad@example.com" || !e.Permanent() {
+		t.Errorf("unexpected error: %+v", e)
+	}
+	if e := res.Rejected[1]; e.Code != 451 || e.Enhanced != "4.3.0" || !e.Temporary() {
+		t.Errorf("unexpected error: %+v", e)
+	}
+	srv.mu.Lock()
+	if len(srv.msgs) != 0 {
+		t.Errorf("message should not have been sent")
+	}
+	srv.mu.Unlock()
+
+	// partial delivery sends to accepted recipients
+	r.PartialDelivery = true
+	res, err = m.Deliver(context.Background(), r)
+	if err != nil || len(res.Rejected) != 2 {
+		t.Fatalf("unexpected partial delivery result: %+v, %v", res, err)
+	}
+	srv.mu.Lock()
+	if len(srv.msgs) != 1 {
+		t.Errorf("message should have been sent")
+	}
+	srv.mu.Unlock()
+	if err := m.Send(r); err == nil {
+		t.Errorf("Send should report rejected recipients")
+	}
+
+	// errors in other phases
+	srv.fail["MAIL"] = "552 5.3.4 Message too big"
+	var se *pmail.SMTPError
+	if err := m.Send(r); !errors.As(err, &se) || se.Phase != pmail.PhaseMail || se.Code != 552 {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestRelaySenderInjection(t *testing.T) {
+	srv := newFakeSMTP(t, "")
+	srv.start()
+	r := &pmail.RelaySender{Host: "127.0.0.1", Port: srv.port()}
+
+	env := pmail.NewEnvelope("test@example.com", "bob@example.com>\r\nRCPT TO:<evil@example.com")
+	res, err := r.Deliver(context.Background(), env, testMail())
+	var se *pmail.SMTPError
+	if !errors.As(err, &se) || se.Phase != pmail.PhaseRcpt || !se.Permanent() || len(res.Rejected) != 1 {
+		t.Errorf("injected recipient should be refused, got %+v, %v", res, err)
+	}
+	env = pmail.NewEnvelope("test@example.com> NOTIFY=NEVER", "bob@example.com")
+	if _, err := r.Deliver(context.Background(), env, testMail()); !errors.As(err, &se) || se.Phase != pmail.PhaseMail {
+		t.Errorf("injected sender should be refused, got %v", err)
+	}
+	r.LocalName = "client.test\r\nRSET"
+	if err := testMail().Send(r); !errors.As(err, &se) || se.Phase != pmail.PhaseConnect {
+		t.Errorf("injected local name should be refused, got %v", err)
+	}
+
+	for _, cmd := range srv.commands() {
+		if strings.Contains(cmd, "evil") || strings.Contains(cmd, "NOTIFY") || cmd == "RSET" {
+			t.Errorf("injected command sent to server: %s", cmd)
+		}
+	}
+	srv.mu.Lock()
+	if len(srv.msgs) != 0 {
+		t.Errorf("message should not have been sent")
+	}
+	srv.mu.Unlock()
+}
+
+func TestRelaySenderAuth(t *testing.T) {
+	srv := newFakeSMTP(t, "")
+	srv.ext = []string{"AUTH LOGIN CRAM-MD5"}
+	srv.start()
+
+	r := pmail.NewDialer("127.0.0.1", srv.port(), "user", "secret")
+	if err := testMail().Send(r); err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	cmds := srv.commands()
+	expect := []string{"AUTH LOGIN", "dXNlcg==", "c2VjcmV0"}
+	if len(cmds) < 4 || strings.Join(cmds[1:4], " ") != strings.Join(expect, " ") {
+		t.Errorf("unexpected auth exchange: %v", cmds)
+	}
+
+	srv = newFakeSMTP(t, "")
+	srv.ext = []string{"AUTH PLAIN XOAUTH2"}
+	srv.start()
+
+	r = &pmail.RelaySender{Host: "127.0.0.1", Port: srv.port(), Auth: pmail.OAuth2Auth("user@example.com", pmail.StaticToken("tok3n"), "127.0.0.1")}
+	if err := testMail().Send(r); err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	cmds = srv.commands()
+	resp := base64.StdEncoding.EncodeToString([]byte("user=user@example.com\x01auth=Bearer tok3n\x01\x01"))
+	if len(cmds) < 2 || cmds[1] != "AUTH XOAUTH2 "+resp {
+		t.Errorf("unexpected auth exchange: %v", cmds)
+	}
+
+	// OAUTHBEARER escapes the identity in the GS2 header
+	a := pmail.OAuthBearerAuth("a,b=c@example.com", pmail.StaticToken("tok3n"), "127.0.0.1")
+	mech, ir, err := a.Start(&smtp.ServerInfo{Name: "127.0.0.1", Auth: []string{"OAUTHBEARER"}})
+	if err != nil || mech != "OAUTHBEARER" || string(ir) != "n,a=a=2Cb=3Dc@example.com,\x01host=127.0.0.1\x01auth=Bearer tok3n\x01\x01" {
+		t.Errorf("unexpected OAUTHBEARER response %q, %v", ir, err)
+	}
+}
+
+func TestRelaySenderExtensions(t *testing.T) {
+	const raw = "From: test@example.com\r\nTo: bob@example.com, bad@example.com\r\nSubject: 8bit\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\nVoilà un café\r\n"
+
+	srv := newFakeSMTP(t, "")
+	srv.ext = []string{"PIPELINING", "CHUNKING", "8BITMIME", "SIZE 100000"}
+	srv.fail["RCPT TO:<bad@example.com>"] = "550 5.1.1 User unknown"
+	srv.start()
+
+	m, err := pmail.Parse(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	r := &pmail.RelaySender{Host: "127.0.0.1", Port: srv.port(), PartialDelivery: true}
+	res, err := m.Deliver(context.Background(), r)
+	if err != nil || len(res.Accepted) != 1 || len(res.Rejected) != 1 {
+		t.Fatalf("unexpected result: %+v, %v", res, err)
+	}
+	cmds := srv.commands()
+	if !strings.HasPrefix(cmds[1], "MAIL FROM:<test@example.com> BODY=8BITMIME SIZE=") {
+		t.Errorf("unexpected MAIL command: %s", cmds[1])
+	}
+	if !strings.HasPrefix(cmds[4], "BDAT ") || !strings.HasSuffix(cmds[4], " LAST") {
+		t.Errorf("expected BDAT, got %s", cmds[4])
+	}
+	srv.mu.Lock()
+	if len(srv.msgs) != 1 || !strings.Contains(srv.msgs[0], "Voilà un café") {
+		t.Errorf("unexpected message: %q", srv.msgs)
+	}
+	srv.mu.Unlock()
+
+	// server without 8BITMIME and with a small size limit
+	srv = newFakeSMTP(t, "")
+	srv.ext = []string{"SIZE 400"}
+	srv.start()
+	r = &pmail.RelaySender{Host: "127.0.0.1", Port: srv.port(), PartialDelivery: true}
+	if _, err := m.Deliver(context.Background(), r); err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	srv.mu.Lock()
+	if len(srv.msgs) != 1 || !strings.Contains(srv.msgs[0], "Voil=C3=A0 un caf=C3=A9") {
+		t.Errorf("message should have been converted to quoted-printable: %q", srv.msgs)
+	}
+	srv.mu.Unlock()
+	if !m.Body.Uses8Bit() {
+		t.Errorf("the conversion should not modify the email")
+	}
+
+	m = testMail()
+	m.SetBodyText(strings.Repeat("Too large. ", 50))
+	var se *pmail.SMTPError
+	if err := m.Send(r); !errors.As(err, &se) || se.Code != 552 || se.Phase != pmail.PhaseMail {
+		t.Errorf("expected size error, got %v", err)
+	}
+	for _, cmd := range srv.commands()[4:] {
+		if strings.HasPrefix(cmd, "MAIL") {
+			t.Errorf("MAIL should not be sent for messages exceeding the size limit")
+		}
+	}
+}
+
+func TestRelaySenderDSN(t *testing.T) {
+	srv := newFakeSMTP(t, "")
+	srv.ext = []string{"DSN"}
+	srv.start()
+
+	m := testMail()
+	m.MessageId = "invoice-42@example.com"
+	m.RequestDSN(pmail.RetHeaders, pmail.NotifyFailure, pmail.NotifyDelay)
+	r := &pmail.RelaySender{Host: "127.0.0.1", Port: srv.port()}
+	if err := m.Send(r); err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	cmds := srv.commands()
+	if cmds[1] != "MAIL FROM:<test@example.com> RET=HDRS ENVID=invoice-42@example.com" {
+		t.Errorf("unexpected MAIL command: %s", cmds[1])
+	}
+	if cmds[2] != "RCPT TO:<bob@example.com> NOTIFY=FAILURE,DELAY ORCPT=rfc822;bob@example.com" {
+		t.Errorf("unexpected RCPT command: %s", cmds[2])
+	}
+
+	// parameters are not sent to servers without DSN
+	srv = newFakeSMTP(t, "").start()
+	r.Port = srv.port()
+	if err := m.Send(r); err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	if cmds := srv.commands(); cmds[1] != "MAIL FROM:<test@example.com>" || cmds[2] != "RCPT TO:<bob@example.com>" {
+		t.Errorf("unexpected commands: %q", cmds)
+	}
+}
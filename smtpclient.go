@@ -0,0 +1,357 @@
+package pmail
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// smtpClient is a minimal SMTP client session. Unlike net/smtp it gives full control over
+// the parameters of the MAIL and RCPT commands, as needed for DSN and other extensions.
+type smtpClient struct {
+	conn  net.Conn
+	text  *textproto.Conn
+	host  string            // server name, used for TLS verification and auth
+	ext   map[string]string // extensions advertised in EHLO response
+	auth  []string          // advertised auth mechanisms
+	isTLS bool
+	lmtp  bool // speak LMTP (RFC 2033) instead of SMTP
+
+	accepted int     // LMTP: number of recipients accepted for the current message
+	rcptErrs []error // LMTP: per-recipient replies received after the message
+
+	cmdTimeout  time.Duration // timeout for each command
+	dataTimeout time.Duration // timeout for the transmission of the message
+}
+
+// newSMTPClient initializes a session on an existing connection and reads the server greeting
+func newSMTPClient(conn net.Conn, host string, cmdTimeout time.Duration) (*smtpClient, error) {
+	c := &smtpClient{conn: conn, text: textproto.NewConn(conn), host: host, cmdTimeout: cmdTimeout}
+	_, c.isTLS = conn.(*tls.Conn)
+
+	c.setTimeout(c.cmdTimeout)
+	if _, _, err := c.text.ReadResponse(220); err != nil {
+		c.text.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// setTimeout sets the deadline for the next operation on the connection
+func (c *smtpClient) setTimeout(d time.Duration) {
+	if d > 0 {
+		c.conn.SetDeadline(time.Now().Add(d))
+	} else {
+		c.conn.SetDeadline(time.Time{})
+	}
+}
+
+func (c *smtpClient) cmd(expectCode int, format string, args ...any) (int, string, error) {
+	c.setTimeout(c.cmdTimeout)
+	id, err := c.text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+	return c.text.ReadResponse(expectCode)
+}
+
+// hello sends EHLO, falling back to HELO if the server does not support it, or LHLO for LMTP
+func (c *smtpClient) hello(localName string) error {
+	if err := checkArg("local name", localName); err != nil {
+		return err
+	}
+	if c.lmtp {
+		_, msg, err := c.cmd(250, "LHLO %s", localName)
+		if err != nil {
+			return err
+		}
+		c.parseExtensions(msg)
+		return nil
+	}
+	_, msg, err := c.cmd(250, "EHLO %s", localName)
+	if err != nil {
+		if _, _, err := c.cmd(250, "HELO %s", localName); err != nil {
+			return err
+		}
+		c.ext = make(map[string]string)
+		return nil
+	}
+	c.parseExtensions(msg)
+	return nil
+}
+
+func (c *smtpClient) parseExtensions(msg string) {
+	c.ext = make(map[string]string)
+	c.auth = nil
+
+	lines := strings.Split(msg, "\n")
+	// first line is the server greeting
+	for _, line := range lines[1:] {
+		k, v, _ := strings.Cut(line, " ")
+		c.ext[strings.ToUpper(k)] = v
+	}
+	if mechs, ok := c.ext["AUTH"]; ok {
+		c.auth = strings.Fields(mechs)
+	}
+}
+
+// extension returns whether the server supports the given extension, and its parameters
+func (c *smtpClient) extension(name string) (bool, string) {
+	v, ok := c.ext[strings.ToUpper(name)]
+	return ok, v
+}
+
+// startTLS upgrades the connection to TLS. hello must be called again afterward.
+func (c *smtpClient) startTLS(cfg *tls.Config) error {
+	if _, _, err := c.cmd(220, "STARTTLS"); err != nil {
+		return err
+	}
+	tc := tls.Client(c.conn, cfg)
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	c.conn = tc
+	c.text = textproto.NewConn(tc)
+	c.isTLS = true
+	return nil
+}
+
+// authenticate runs the AUTH exchange for the given mechanism
+func (c *smtpClient) authenticate(a smtp.Auth) error {
+	encoding := base64.StdEncoding
+	info := &smtp.ServerInfo{Name: c.host, TLS: c.isTLS, Auth: c.auth}
+
+	var mech string
+	var resp []byte
+	var err error
+	if sel, ok := a.(authSelector); ok {
+		a, mech, resp, err = sel.selectAuth(info)
+	} else {
+		mech, resp, err = a.Start(info)
+	}
+	if err != nil {
+		return err
+	}
+
+	code, msg64, err := c.cmd(0, strings.TrimSpace(fmt.Sprintf("AUTH %s %s", mech, encoding.EncodeToString(resp))))
+	for err == nil {
+		var msg []byte
+		switch code {
+		case 334:
+			msg, err = encoding.DecodeString(msg64)
+		case 235:
+			// the last message isn't base64 because it isn't a challenge
+			msg = []byte(msg64)
+		default:
+			err = &textproto.Error{Code: code, Msg: msg64}
+		}
+		if err == nil {
+			resp, err = a.Next(msg, code == 334)
+		}
+		if err != nil {
+			if code == 334 {
+				// abort the AUTH exchange
+				c.cmd(501, "*")
+			}
+			return err
+		}
+		if resp == nil {
+			return nil
+		}
+		code, msg64, err = c.cmd(0, encoding.EncodeToString(resp))
+	}
+	return err
+}
+
+// checkArg returns an error if s cannot be used safely as an argument of a SMTP command, as it
+// would allow injecting other commands or parameters. It must be called on addresses before
+// calling mailCommand or rcptCommand.
+func checkArg(what, s string) error {
+	if strings.ContainsAny(s, "\r\n<>") {
+		return fmt.Errorf("cannot send email: invalid %s %q", what, s)
+	}
+	return nil
+}
+
+// mailCommand returns the MAIL FROM command with the given extra parameters
+func mailCommand(from string, params []string) string {
+	return strings.Join(append([]string{"MAIL FROM:<" + from + ">"}, params...), " ")
+}
+
+// rcptCommand returns the RCPT TO command with the given extra parameters
+func rcptCommand(to string, params []string) string {
+	return strings.Join(append([]string{"RCPT TO:<" + to + ">"}, params...), " ")
+}
+
+// pipeline sends all commands without waiting, then reads the replies in order (PIPELINING,
+// RFC 2920). It returns the error for each command.
+func (c *smtpClient) pipeline(cmds []string, codes []int) []error {
+	c.setTimeout(c.cmdTimeout)
+	errs := make([]error, len(cmds))
+	ids := make([]uint, len(cmds))
+	for n, cmd := range cmds {
+		id, err := c.text.Cmd("%s", cmd)
+		if err != nil {
+			for i := range errs {
+				errs[i] = err
+			}
+			return errs
+		}
+		ids[n] = id
+	}
+	for n, id := range ids {
+		c.text.StartResponse(id)
+		_, _, errs[n] = c.text.ReadResponse(codes[n])
+		c.text.EndResponse(id)
+	}
+	return errs
+}
+
+// data sends the DATA command followed by the message
+func (c *smtpClient) data(msg io.WriterTo) error {
+	if _, _, err := c.cmd(354, "DATA"); err != nil {
+		return err
+	}
+	c.setTimeout(c.dataTimeout)
+	wr := c.text.DotWriter()
+	if _, err := msg.WriteTo(wr); err != nil {
+		wr.Close()
+		return err
+	}
+	if err := wr.Close(); err != nil {
+		return err
+	}
+	return c.dataReplies()
+}
+
+// dataReplies reads the replies sent once the message was transmitted: a single reply for
+// SMTP, or one per accepted recipient for LMTP (RFC 2033 4.2), stored in rcptErrs. For LMTP,
+// an error is returned only if the replies could not be read.
+func (c *smtpClient) dataReplies() error {
+	if !c.lmtp {
+		_, _, err := c.text.ReadResponse(250)
+		return err
+	}
+	c.rcptErrs = make([]error, c.accepted)
+	for n := range c.rcptErrs {
+		_, _, err := c.text.ReadResponse(250)
+		var tpErr *textproto.Error
+		if err != nil && !errors.As(err, &tpErr) {
+			return err
+		}
+		c.rcptErrs[n] = err
+	}
+	return nil
+}
+
+// bdatChunkSize is the size of the chunks sent with BDAT
+const bdatChunkSize = 1 << 20
+
+// bdat sends the message using BDAT commands (CHUNKING, RFC 3030). Unlike DATA, the message
+// does not need to be dot-stuffed.
+func (c *smtpClient) bdat(msg io.WriterTo) error {
+	c.setTimeout(c.dataTimeout)
+	cw := &chunkWriter{c: c, buf: make([]byte, 0, bdatChunkSize)}
+	if _, err := msg.WriteTo(cw); err != nil {
+		return err
+	}
+	return cw.flush(true)
+}
+
+// chunkWriter sends data written to it as BDAT chunks, converting bare LF to CRLF as done by
+// DotWriter for DATA
+type chunkWriter struct {
+	c    *smtpClient
+	buf  []byte
+	prev byte
+}
+
+func (w *chunkWriter) Write(b []byte) (int, error) {
+	for _, v := range b {
+		if v == '\n' && w.prev != '\r' {
+			w.buf = append(w.buf, '\r')
+		}
+		w.buf = append(w.buf, v)
+		w.prev = v
+		if len(w.buf) >= bdatChunkSize {
+			if err := w.flush(false); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(b), nil
+}
+
+// flush sends the buffered data as a BDAT chunk
+func (w *chunkWriter) flush(last bool) error {
+	cmd := fmt.Sprintf("BDAT %d", len(w.buf))
+	if last {
+		cmd += " LAST"
+	}
+	id := w.c.text.Next()
+	w.c.text.StartRequest(id)
+	w.c.text.W.WriteString(cmd + "\r\n")
+	w.c.text.W.Write(w.buf)
+	err := w.c.text.W.Flush()
+	w.c.text.EndRequest(id)
+	if err != nil {
+		return err
+	}
+	w.buf = w.buf[:0]
+
+	w.c.text.StartResponse(id)
+	defer w.c.text.EndResponse(id)
+	if last {
+		return w.c.dataReplies()
+	}
+	_, _, err = w.c.text.ReadResponse(250)
+	return err
+}
+
+// reset aborts the current mail transaction, if any
+func (c *smtpClient) reset() error {
+	_, _, err := c.cmd(250, "RSET")
+	return err
+}
+
+func (c *smtpClient) noop() error {
+	_, _, err := c.cmd(250, "NOOP")
+	return err
+}
+
+func (c *smtpClient) quit() error {
+	_, _, err := c.cmd(221, "QUIT")
+	c.close()
+	return err
+}
+
+func (c *smtpClient) close() error {
+	return c.text.Close()
+}
+
+// watchContext interrupts any pending operation on conn by closing it when ctx is done. The
+// returned function must be called once the connection is not used anymore.
+func watchContext(ctx context.Context, conn net.Conn) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
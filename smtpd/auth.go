@@ -0,0 +1,99 @@
+package smtpd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+)
+
+// authAllowed returns true if AUTH can be used on the connection
+func (c *conn) authAllowed() bool {
+	return c.srv.Authenticate != nil && (c.sess.TLS != nil || c.srv.AllowInsecureAuth)
+}
+
+// auth handles AUTH <mechanism> [initial-response] (RFC 4954)
+func (c *conn) auth(arg string) {
+	switch {
+	case c.srv.Authenticate == nil:
+		c.reply(502, "5.5.1", "Command not implemented")
+		return
+	case !c.ehlo:
+		c.reply(503, "5.5.1", "Send EHLO first")
+		return
+	case c.sess.Username != "":
+		c.reply(503, "5.5.1", "Already authenticated")
+		return
+	case c.env != nil:
+		c.reply(503, "5.5.1", "AUTH not permitted during a mail transaction")
+		return
+	case !c.authAllowed():
+		c.reply(538, "5.7.11", "Encryption required for requested authentication mechanism")
+		return
+	}
+
+	mech, initial, _ := strings.Cut(arg, " ")
+	var username, password string
+	var ok bool
+	switch strings.ToUpper(mech) {
+	case "PLAIN":
+		var resp []byte
+		if resp, ok = c.authResponse(initial, ""); !ok {
+			return
+		}
+		// authorization identity, authentication identity and password
+		parts := bytes.Split(resp, []byte{0})
+		if len(parts) != 3 {
+			c.reply(501, "5.5.2", "Invalid PLAIN response")
+			return
+		}
+		username, password = string(parts[1]), string(parts[2])
+	case "LOGIN":
+		var user, pass []byte
+		if user, ok = c.authResponse(initial, "VXNlcm5hbWU6"); !ok { // "Username:"
+			return
+		}
+		if pass, ok = c.authResponse("", "UGFzc3dvcmQ6"); !ok { // "Password:"
+			return
+		}
+		username, password = string(user), string(pass)
+	default:
+		c.reply(504, "5.5.4", "Unrecognized authentication type")
+		return
+	}
+
+	if err := c.srv.Authenticate(c.sess, username, password); err != nil {
+		c.replyErr(err, 535, "5.7.8", "Authentication credentials invalid")
+		return
+	}
+	c.sess.Username = username
+	c.reply(235, "2.7.0", "Authentication successful")
+}
+
+// authResponse returns the decoded client response, sending the challenge to get it if the
+// client did not provide an initial response. It returns false if an error was sent.
+func (c *conn) authResponse(initial, challenge string) ([]byte, bool) {
+	resp := initial
+	if resp == "" {
+		c.reply(334, "", challenge)
+		ln, err := c.readLine()
+		if err != nil {
+			c.quit = true
+			return nil, false
+		}
+		resp = ln
+	}
+	switch resp {
+	case "*":
+		c.reply(501, "5.0.0", "Authentication cancelled")
+		return nil, false
+	case "=":
+		// empty initial response
+		return []byte{}, true
+	}
+	data, err := base64.StdEncoding.DecodeString(resp)
+	if err != nil {
+		c.reply(501, "5.5.2", "Cannot decode response")
+		return nil, false
+	}
+	return data, true
+}
@@ -0,0 +1,530 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KarpelesLab/pmail"
+)
+
+// maxLine is the maximum length of a command line, larger than the 512 bytes of RFC 5321
+// 4.5.3.1.4 to allow for extension parameters
+const maxLine = 4096
+
+var (
+	errLineTooLong     = errors.New("line too long")
+	errMessageTooLarge = errors.New("message too large")
+)
+
+// conn is a client connection
+type conn struct {
+	srv  *Server
+	c    net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+	ctx  context.Context
+	sess *Session
+
+	ehlo   bool            // client used EHLO
+	env    *pmail.Envelope // current transaction, nil if MAIL FROM was not received
+	errors int             // number of error replies sent
+	quit   bool
+}
+
+func newConn(s *Server, nc net.Conn) *conn {
+	c := &conn{srv: s, ctx: s.ctx, sess: &Session{RemoteAddr: nc.RemoteAddr()}}
+	c.setConn(nc)
+	return c
+}
+
+func (c *conn) setConn(nc net.Conn) {
+	c.c = nc
+	c.r = bufio.NewReaderSize(nc, maxLine)
+	c.w = bufio.NewWriter(nc)
+	if tc, ok := nc.(*tls.Conn); ok {
+		st := tc.ConnectionState()
+		c.sess.TLS = &st
+	}
+}
+
+func (c *conn) serve() {
+	defer c.c.Close()
+
+	if tc, ok := c.c.(*tls.Conn); ok {
+		// implicit TLS, run the handshake now to fill the session state
+		tc.SetDeadline(time.Now().Add(timeoutOrDefault(c.srv.CommandTimeout, defaultCommandTimeout)))
+		if err := tc.Handshake(); err != nil {
+			return
+		}
+		c.setConn(tc)
+	}
+
+	c.reply(220, "", c.srv.hostname()+" ESMTP ready")
+	for !c.quit {
+		ln, err := c.readLine()
+		if err != nil {
+			if errors.Is(err, errLineTooLong) {
+				c.reply(500, "5.5.6", "Line too long")
+				continue
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				c.reply(421, "4.4.2", "Timeout, closing connection")
+				c.w.Flush()
+			}
+			return
+		}
+		c.handle(ln)
+		if c.errors >= c.srv.maxErrors() {
+			c.reply(421, "4.7.0", "Too many errors, closing connection")
+			break
+		}
+	}
+	c.w.Flush()
+}
+
+// readLine reads a command line. Replies are buffered while the client pipelines commands,
+// and sent once all received commands were processed.
+func (c *conn) readLine() (string, error) {
+	if c.r.Buffered() == 0 {
+		if err := c.w.Flush(); err != nil {
+			return "", err
+		}
+	}
+	c.c.SetDeadline(time.Now().Add(timeoutOrDefault(c.srv.CommandTimeout, defaultCommandTimeout)))
+	ln, err := c.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// discard the rest of the line
+		for err == bufio.ErrBufferFull {
+			_, err = c.r.ReadSlice('\n')
+		}
+		if err == nil {
+			err = errLineTooLong
+		}
+		return "", err
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(ln), "\r\n"), nil
+}
+
+// reply sends a reply to the client. enhanced is the RFC 3463 status code, if any.
+func (c *conn) reply(code int, enhanced, msg string) {
+	if code >= 500 {
+		c.errors++
+	}
+	if enhanced != "" && c.ehlo {
+		msg = enhanced + " " + msg
+	}
+	fmt.Fprintf(c.w, "%d %s\r\n", code, msg)
+}
+
+// replyLines sends a multiline reply
+func (c *conn) replyLines(code int, lines []string) {
+	for n, ln := range lines {
+		sep := "-"
+		if n == len(lines)-1 {
+			sep = " "
+		}
+		fmt.Fprintf(c.w, "%d%s%s\r\n", code, sep, ln)
+	}
+}
+
+// replyErr sends the reply for an error returned by the handler, using the given reply if
+// err is not a *pmail.SMTPError with a reply code
+func (c *conn) replyErr(err error, code int, enhanced, msg string) {
+	var se *pmail.SMTPError
+	if errors.As(err, &se) && se.Code >= 400 && se.Code < 600 {
+		code, enhanced, msg = se.Code, se.Enhanced, se.Message
+	}
+	c.reply(code, enhanced, msg)
+}
+
+func (c *conn) handle(ln string) {
+	verb, arg, _ := strings.Cut(ln, " ")
+	arg = strings.TrimSpace(arg)
+	switch strings.ToUpper(verb) {
+	case "EHLO":
+		c.hello(arg, true)
+	case "HELO":
+		c.hello(arg, false)
+	case "STARTTLS":
+		c.startTLS()
+	case "AUTH":
+		c.auth(arg)
+	case "MAIL":
+		c.mail(arg)
+	case "RCPT":
+		c.rcpt(arg)
+	case "DATA":
+		c.data()
+	case "RSET":
+		c.env = nil
+		c.reply(250, "2.0.0", "OK")
+	case "NOOP":
+		c.reply(250, "2.0.0", "OK")
+	case "VRFY":
+		c.reply(252, "2.5.0", "Cannot verify user, but will accept message and attempt delivery")
+	case "QUIT":
+		c.reply(221, "2.0.0", "Bye")
+		c.quit = true
+	default:
+		c.reply(500, "5.5.2", "Command not recognized")
+	}
+}
+
+func (c *conn) hello(name string, ehlo bool) {
+	if name == "" {
+		c.reply(501, "5.5.4", "Missing domain name")
+		return
+	}
+	c.sess.Hello = name
+	c.ehlo = ehlo
+	c.env = nil
+	if !ehlo {
+		c.reply(250, "", c.srv.hostname())
+		return
+	}
+
+	lines := []string{
+		c.srv.hostname() + " greets " + name,
+		"PIPELINING",
+		"8BITMIME",
+		"SMTPUTF8",
+		"ENHANCEDSTATUSCODES",
+		"DSN",
+		"SIZE " + strconv.FormatInt(c.srv.maxMessageSize(), 10),
+	}
+	if c.srv.TLSConfig != nil && c.sess.TLS == nil {
+		lines = append(lines, "STARTTLS")
+	}
+	if c.authAllowed() {
+		lines = append(lines, "AUTH PLAIN LOGIN")
+	}
+	c.replyLines(250, lines)
+}
+
+func (c *conn) startTLS() {
+	switch {
+	case c.srv.TLSConfig == nil:
+		c.reply(502, "5.5.1", "Command not implemented")
+		return
+	case c.sess.TLS != nil:
+		c.reply(503, "5.5.1", "Already using TLS")
+		return
+	}
+	c.reply(220, "2.0.0", "Ready to start TLS")
+	if err := c.w.Flush(); err != nil {
+		c.quit = true
+		return
+	}
+
+	tc := tls.Server(c.c, c.srv.TLSConfig)
+	if err := tc.Handshake(); err != nil {
+		c.quit = true
+		return
+	}
+	// anything the client sent before the handshake is discarded (RFC 3207 4.2)
+	c.setConn(tc)
+	c.sess.Hello = ""
+	c.ehlo = false
+	c.env = nil
+}
+
+// mail handles MAIL FROM:<address> [params]
+func (c *conn) mail(arg string) {
+	switch {
+	case c.sess.Hello == "":
+		c.reply(503, "5.5.1", "Send HELO/EHLO first")
+		return
+	case c.env != nil:
+		c.reply(503, "5.5.1", "Nested MAIL command")
+		return
+	case c.srv.RequireTLS && c.sess.TLS == nil:
+		c.reply(530, "5.7.0", "Must issue a STARTTLS command first")
+		return
+	case c.srv.RequireAuth && c.sess.Username == "":
+		c.reply(530, "5.7.0", "Authentication required")
+		return
+	}
+	from, params, ok := parsePath(arg, "FROM:")
+	if !ok {
+		c.reply(501, "5.5.4", "Syntax: MAIL FROM:<address>")
+		return
+	}
+
+	if _, ok := params["SMTPUTF8"]; !ok && !isASCII(from) {
+		c.reply(553, "5.6.7", "Non-ASCII addresses require SMTPUTF8")
+		return
+	}
+
+	env := &pmail.Envelope{From: from}
+	for k, v := range params {
+		switch k {
+		case "SIZE":
+			size, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				c.reply(501, "5.5.4", "Invalid SIZE parameter")
+				return
+			}
+			if size > c.srv.maxMessageSize() {
+				c.reply(552, "5.3.4", "Message size exceeds fixed maximum message size")
+				return
+			}
+		case "BODY":
+			switch strings.ToUpper(v) {
+			case "7BIT":
+			case "8BITMIME":
+				env.EightBitMIME = true
+			default:
+				c.reply(501, "5.5.4", "Unsupported BODY parameter")
+				return
+			}
+		case "SMTPUTF8":
+			env.SMTPUTF8 = true
+		case "RET":
+			env.Ret = strings.ToUpper(v)
+			if env.Ret != pmail.RetFull && env.Ret != pmail.RetHeaders {
+				c.reply(501, "5.5.4", "Invalid RET parameter")
+				return
+			}
+		case "ENVID":
+			env.EnvID, ok = decodeXtext(v)
+			if !ok {
+				c.reply(501, "5.5.4", "Invalid ENVID parameter")
+				return
+			}
+		default:
+			c.reply(555, "5.5.4", "Unsupported parameter "+k)
+			return
+		}
+	}
+
+	if mc, ok := c.srv.Handler.(MailChecker); ok {
+		if err := mc.CheckMail(c.ctx, c.sess, from); err != nil {
+			c.replyErr(err, 451, "4.3.0", "Sender rejected")
+			return
+		}
+	}
+	c.env = env
+	c.reply(250, "2.1.0", "OK")
+}
+
+// rcpt handles RCPT TO:<address> [params]
+func (c *conn) rcpt(arg string) {
+	if c.env == nil {
+		c.reply(503, "5.5.1", "Need MAIL command first")
+		return
+	}
+	if len(c.env.Recipients) >= c.srv.maxRecipients() {
+		c.reply(452, "4.5.3", "Too many recipients")
+		return
+	}
+	to, params, ok := parsePath(arg, "TO:")
+	if !ok || to == "" {
+		c.reply(501, "5.5.4", "Syntax: RCPT TO:<address>")
+		return
+	}
+
+	if !c.env.SMTPUTF8 && !isASCII(to) {
+		c.reply(553, "5.6.7", "Non-ASCII addresses require SMTPUTF8")
+		return
+	}
+
+	rcpt := &pmail.Recipient{Address: to}
+	for k, v := range params {
+		switch k {
+		case "NOTIFY":
+			rcpt.Notify = strings.Split(strings.ToUpper(v), ",")
+		case "ORCPT":
+			rcpt.ORCPT, ok = decodeXtext(v)
+			if !ok {
+				c.reply(501, "5.5.4", "Invalid ORCPT parameter")
+				return
+			}
+		default:
+			c.reply(555, "5.5.4", "Unsupported parameter "+k)
+			return
+		}
+	}
+
+	if rc, ok := c.srv.Handler.(RcptChecker); ok {
+		if err := rc.CheckRcpt(c.ctx, c.sess, to); err != nil {
+			c.replyErr(err, 451, "4.3.0", "Recipient rejected")
+			return
+		}
+	}
+	c.env.Recipients = append(c.env.Recipients, rcpt)
+	c.reply(250, "2.1.5", "OK")
+}
+
+func (c *conn) data() {
+	switch {
+	case c.env == nil:
+		c.reply(503, "5.5.1", "Need MAIL command first")
+		return
+	case len(c.env.Recipients) == 0:
+		c.reply(503, "5.5.1", "Need RCPT command first")
+		return
+	}
+	c.reply(354, "", "Start mail input; end with <CRLF>.<CRLF>")
+	if err := c.w.Flush(); err != nil {
+		c.quit = true
+		return
+	}
+
+	env := c.env
+	c.env = nil
+	c.c.SetDeadline(time.Now().Add(timeoutOrDefault(c.srv.DataTimeout, defaultDataTimeout)))
+	data, err := c.readData()
+	switch {
+	case errors.Is(err, errMessageTooLarge):
+		c.reply(552, "5.3.4", "Message size exceeds fixed maximum message size")
+		return
+	case err != nil:
+		c.quit = true
+		return
+	}
+
+	m, err := pmail.Parse(bytes.NewReader(data))
+	if err != nil {
+		c.reply(554, "5.6.0", "Malformed message")
+		return
+	}
+	if c.srv.Handler != nil {
+		c.sess.Data = data
+		err = c.srv.Handler.ServeSMTP(c.ctx, c.sess, env, m)
+		c.sess.Data = nil
+	}
+	if err != nil {
+		c.replyErr(err, 451, "4.3.0", "Error processing message")
+		return
+	}
+	c.reply(250, "2.0.0", "OK: queued")
+}
+
+// readData reads a message terminated by a line containing a single dot, removing dot
+// stuffing and making sure lines end with CRLF. If the message exceeds the maximum size, it is
+// read entirely and errMessageTooLarge is returned.
+func (c *conn) readData() ([]byte, error) {
+	max := c.srv.maxMessageSize()
+	buf := &bytes.Buffer{}
+	tooLarge := false
+	start := true // at the start of a line
+	for {
+		ln, err := c.r.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		full := err == nil
+		if start {
+			if full && (string(ln) == ".\r\n" || string(ln) == ".\n") {
+				break
+			}
+			if ln[0] == '.' {
+				ln = ln[1:]
+			}
+		}
+		start = full
+		if tooLarge {
+			continue
+		}
+		if full && !bytes.HasSuffix(ln, []byte("\r\n")) {
+			buf.Write(ln[:len(ln)-1])
+			buf.WriteString("\r\n")
+		} else {
+			buf.Write(ln)
+		}
+		if int64(buf.Len()) > max {
+			tooLarge = true
+			buf.Reset()
+		}
+	}
+	if tooLarge {
+		return nil, errMessageTooLarge
+	}
+	return buf.Bytes(), nil
+}
+
+// parsePath parses the argument of MAIL or RCPT, such as "FROM:<address> KEY=value". Params
+// keys are returned in upper case.
+func parsePath(arg, prefix string) (string, map[string]string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+	arg = strings.TrimLeft(arg[len(prefix):], " ")
+	if !strings.HasPrefix(arg, "<") {
+		return "", nil, false
+	}
+	// find the end of the path, a quoted local-part may contain '>' (RFC 5321 4.1.2)
+	end, quoted := -1, false
+	for i := 1; i < len(arg) && end == -1; i++ {
+		switch {
+		case quoted && arg[i] == '\\':
+			i++ // quoted-pair
+		case arg[i] == '"':
+			quoted = !quoted
+		case arg[i] == '>' && !quoted:
+			end = i
+		}
+	}
+	if end == -1 {
+		return "", nil, false
+	}
+	addr := arg[1:end]
+	if pos := strings.IndexByte(addr, ':'); pos != -1 && strings.HasPrefix(addr, "@") {
+		// obsolete source route
+		addr = addr[pos+1:]
+	}
+
+	params := make(map[string]string)
+	for _, p := range strings.Fields(arg[end+1:]) {
+		k, v, _ := strings.Cut(p, "=")
+		params[strings.ToUpper(k)] = v
+	}
+	return addr, params, true
+}
+
+// isASCII returns true if s only contains ASCII characters, as required for addresses given
+// without the SMTPUTF8 parameter (RFC 6531 3.5)
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeXtext decodes a xtext value (RFC 3461 4)
+func decodeXtext(s string) (string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '+' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", false
+		}
+		v, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", false
+		}
+		b.WriteByte(byte(v))
+		i += 2
+	}
+	return b.String(), true
+}
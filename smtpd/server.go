@@ -0,0 +1,274 @@
+// Package smtpd implements a SMTP server receiving messages as *pmail.Mail, usable as an
+// inbound MX or as a local server for testing senders.
+package smtpd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/KarpelesLab/pmail"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Close or Shutdown was called
+var ErrServerClosed = errors.New("smtpd: server closed")
+
+// Handler processes messages received by the server. Returning a *pmail.SMTPError with a
+// reply code sends that reply to the client, other errors result in a temporary failure.
+type Handler interface {
+	ServeSMTP(ctx context.Context, s *Session, env *pmail.Envelope, m *pmail.Mail) error
+}
+
+// HandlerFunc allows using a function as a Handler
+type HandlerFunc func(ctx context.Context, s *Session, env *pmail.Envelope, m *pmail.Mail) error
+
+func (f HandlerFunc) ServeSMTP(ctx context.Context, s *Session, env *pmail.Envelope, m *pmail.Mail) error {
+	return f(ctx, s, env, m)
+}
+
+// MailChecker can be implemented by handlers to accept or reject the sender when MAIL FROM
+// is received, before the message is transmitted
+type MailChecker interface {
+	CheckMail(ctx context.Context, s *Session, from string) error
+}
+
+// RcptChecker can be implemented by handlers to accept or reject each recipient when RCPT TO
+// is received, for example to refuse unknown mailboxes
+type RcptChecker interface {
+	CheckRcpt(ctx context.Context, s *Session, to string) error
+}
+
+// Server is a SMTP server supporting the PIPELINING, 8BITMIME, SMTPUTF8, SIZE, DSN, STARTTLS
+// and AUTH (PLAIN and LOGIN) extensions
+type Server struct {
+	Addr     string  // address to listen on, defaults to ":25"
+	Hostname string  // name sent in the greeting, defaults to os.Hostname
+	Handler  Handler // messages are discarded if nil
+
+	TLSConfig  *tls.Config // enables STARTTLS if set
+	RequireTLS bool        // refuse transactions until STARTTLS was used
+
+	// Authenticate enables AUTH and checks the given credentials. AUTH is only available on
+	// TLS connections unless AllowInsecureAuth is set.
+	Authenticate      func(s *Session, username, password string) error
+	RequireAuth       bool // refuse transactions from unauthenticated clients
+	AllowInsecureAuth bool
+
+	MaxMessageSize int64 // maximum size of messages in bytes, defaults to 32MB
+	MaxRecipients  int   // maximum number of recipients per message, defaults to 100
+	MaxConnections int   // maximum number of simultaneous connections, unlimited if zero
+	MaxErrors      int   // number of error replies after which the connection is closed, defaults to 10
+
+	CommandTimeout time.Duration // timeout for reading each command, defaults to 5 minutes
+	DataTimeout    time.Duration // timeout for receiving a message, defaults to 10 minutes
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*conn]struct{}
+	closed    bool
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+const (
+	defaultMaxMessageSize = 32 << 20
+	defaultMaxRecipients  = 100
+	defaultMaxErrors      = 10
+	defaultCommandTimeout = 5 * time.Minute  // RFC 5321 4.5.3.2.7
+	defaultDataTimeout    = 10 * time.Minute // RFC 5321 4.5.3.2.6
+)
+
+// Session holds information about a client connection
+type Session struct {
+	RemoteAddr net.Addr
+	Hello      string               // name given by the client in HELO or EHLO
+	TLS        *tls.ConnectionState // TLS state, nil if the connection is not using TLS
+	Username   string               // authenticated user, empty if the client did not authenticate
+	Data       []byte               // raw message being handled, with CRLF line endings
+}
+
+// ListenAndServe listens on Addr and serves connections until the server is closed
+func (s *Server) ListenAndServe() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = ":25"
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until the server is closed. l can be a TLS listener to
+// serve implicit TLS connections. l is closed when Serve returns.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.track(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.untrack(l)
+
+	var delay time.Duration
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				// back off on errors such as running out of file descriptors
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay < time.Second {
+					delay *= 2
+				}
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		s.accept(c)
+	}
+}
+
+// Close immediately closes all listeners and connections
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeListeners()
+	for c := range s.conns {
+		c.c.Close()
+	}
+	return nil
+}
+
+// Shutdown closes all listeners and waits for connections to end, closing them if ctx
+// expires first
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closeListeners()
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.Close()
+		return ctx.Err()
+	}
+}
+
+func (s *Server) closeListeners() {
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+func (s *Server) track(l net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+		s.conns = make(map[*conn]struct{})
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(l net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, l)
+	l.Close()
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// accept starts serving a new connection, unless there are too many connections already
+func (s *Server) accept(nc net.Conn) {
+	s.mu.Lock()
+	if s.MaxConnections > 0 && len(s.conns) >= s.MaxConnections {
+		s.mu.Unlock()
+		nc.SetWriteDeadline(time.Now().Add(time.Second))
+		nc.Write([]byte("421 4.7.0 Too many connections, try again later\r\n"))
+		nc.Close()
+		return
+	}
+	c := newConn(s, nc)
+	s.conns[c] = struct{}{}
+	s.wg.Add(1)
+	s.mu.Unlock()
+
+	go func() {
+		defer s.wg.Done()
+		defer func() {
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+		}()
+		c.serve()
+	}()
+}
+
+func (s *Server) hostname() string {
+	if s.Hostname != "" {
+		return s.Hostname
+	}
+	if h, err := os.Hostname(); err == nil {
+		return h
+	}
+	return "localhost"
+}
+
+func (s *Server) maxMessageSize() int64 {
+	if s.MaxMessageSize > 0 {
+		return s.MaxMessageSize
+	}
+	return defaultMaxMessageSize
+}
+
+func (s *Server) maxRecipients() int {
+	if s.MaxRecipients > 0 {
+		return s.MaxRecipients
+	}
+	return defaultMaxRecipients
+}
+
+func (s *Server) maxErrors() int {
+	if s.MaxErrors > 0 {
+		return s.MaxErrors
+	}
+	return defaultMaxErrors
+}
+
+func timeoutOrDefault(t, def time.Duration) time.Duration {
+	if t == 0 {
+		return def
+	}
+	return t
+}
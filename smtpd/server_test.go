@@ -0,0 +1,243 @@
+package smtpd_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/pmail"
+	"github.com/KarpelesLab/pmail/smtpd"
+)
+
+// recorder is a handler keeping received messages and refusing recipients at example.net
+type recorder struct {
+	mu   sync.Mutex
+	envs []*pmail.Envelope
+	msgs []*pmail.Mail
+	sess []smtpd.Session
+}
+
+func (r *recorder) ServeSMTP(ctx context.Context, s *smtpd.Session, env *pmail.Envelope, m *pmail.Mail) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.envs = append(r.envs, env)
+	r.msgs = append(r.msgs, m)
+	r.sess = append(r.sess, *s)
+	return nil
+}
+
+func (r *recorder) CheckRcpt(ctx context.Context, s *smtpd.Session, to string) error {
+	if strings.HasSuffix(to, "@example.net") {
+		return &pmail.SMTPError{Code: 550, Enhanced: "5.1.1", Message: "No such user"}
+	}
+	return nil
+}
+
+func startServer(t *testing.T, srv *smtpd.Server) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestServer(t *testing.T) {
+	h := &recorder{}
+	srv := &smtpd.Server{
+		Hostname:  "mx.example.com",
+		Handler:   h,
+		TLSConfig: testTLSConfig(t),
+		Authenticate: func(s *smtpd.Session, username, password string) error {
+			if username != "user" || password != "secret" {
+				return errors.New("invalid credentials")
+			}
+			return nil
+		},
+		RequireAuth: true,
+	}
+	port := startServer(t, srv)
+
+	m := pmail.New()
+	m.SetFrom("test@example.com")
+	m.AddTo("bob@example.com")
+	m.SetSubject("Héllo")
+	m.SetBodyText("Hello wörld\n.leading dot\n")
+	m.RequestDSN(pmail.RetHeaders, pmail.NotifyFailure)
+
+	sender := &pmail.RelaySender{
+		Host:       "127.0.0.1",
+		Port:       port,
+		Auth:       pmail.PasswordAuth("user", "secret", "127.0.0.1"),
+		TLSConfig:  &tls.Config{InsecureSkipVerify: true},
+		RequireTLS: true,
+	}
+	if err := m.Send(sender); err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(h.msgs))
+	}
+	env, got, sess := h.envs[0], h.msgs[0], h.sess[0]
+	if sess.Username != "user" || sess.TLS == nil || sess.Hello != "localhost" {
+		t.Errorf("unexpected session: %+v", sess)
+	}
+	if env.From != "test@example.com" || len(env.Recipients) != 1 || env.Ret != pmail.RetHeaders || env.EnvID == "" {
+		t.Errorf("unexpected envelope: %+v", env)
+	}
+	if r := env.Recipients[0]; r.Address != "bob@example.com" || len(r.Notify) != 1 || r.Notify[0] != pmail.NotifyFailure || r.ORCPT != "rfc822;bob@example.com" {
+		t.Errorf("unexpected recipient: %+v", r)
+	}
+	if s := got.Body.Headers.Get("Subject"); s != "Héllo" {
+		t.Errorf("unexpected subject %q", s)
+	}
+	if !strings.Contains(string(sess.Data), "Subject:") || !strings.Contains(string(sess.Data), "\r\n") {
+		t.Errorf("unexpected raw data:\n%s", sess.Data)
+	}
+}
+
+func TestServerRejects(t *testing.T) {
+	h := &recorder{}
+	srv := &smtpd.Server{Hostname: "mx.example.com", Handler: h, MaxMessageSize: 1024}
+	port := startServer(t, srv)
+	sender := &pmail.RelaySender{Host: "127.0.0.1", Port: port, PartialDelivery: true}
+
+	m := pmail.New()
+	m.SetFrom("test@example.com")
+	m.AddTo("bob@example.com")
+	m.AddTo("carol@example.net")
+	m.SetBodyText("Hello")
+	res, err := sender.Deliver(context.Background(), m.DefaultEnvelope(), m)
+	if err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	if len(res.Accepted) != 1 || len(res.Rejected) != 1 || res.Rejected[0].Code != 550 || res.Rejected[0].Enhanced != "5.1.1" {
+		t.Errorf("unexpected result: %+v", res)
+	}
+	if len(h.envs) != 1 || len(h.envs[0].Recipients) != 1 {
+		t.Fatalf("unexpected envelopes: %+v", h.envs)
+	}
+
+	// too large, refused on MAIL FROM thanks to SIZE
+	m.SetBodyText(strings.Repeat("Hello world\n", 200))
+	err = m.Send(sender)
+	var se *pmail.SMTPError
+	if !errors.As(err, &se) || se.Code != 552 {
+		t.Errorf("expected 552 error, got %v", err)
+	}
+}
+
+func TestServerProtocol(t *testing.T) {
+	srv := &smtpd.Server{Hostname: "mx.example.com", MaxErrors: 3}
+	port := startServer(t, srv)
+
+	c, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+	defer c.Close()
+	tc := newTextConn(c)
+
+	tc.expect(t, "220 mx.example.com")
+	tc.send("MAIL FROM:<a@example.com>")
+	tc.expect(t, "503 ")
+	tc.send("EHLO client")
+	tc.expect(t, "250-mx.example.com", "250-PIPELINING", "250-8BITMIME", "250-SMTPUTF8", "250-ENHANCEDSTATUSCODES", "250-DSN", "250 SIZE ")
+	// pipelined transaction, with dot stuffing
+	tc.send("MAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.com>\r\nDATA")
+	tc.expect(t, "250 2.1.0", "250 2.1.5", "354 ")
+	tc.send("From: a@example.com\r\n\r\n..\r\n.")
+	tc.expect(t, "250 2.0.0")
+	tc.send("FOO")
+	tc.expect(t, "500 5.5.2")
+	tc.send("BAR")
+	tc.expect(t, "500 5.5.2", "421 4.7.0")
+}
+
+func TestServerPaths(t *testing.T) {
+	srv := &smtpd.Server{Hostname: "mx.example.com"}
+	port := startServer(t, srv)
+
+	c, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+	defer c.Close()
+	tc := newTextConn(c)
+
+	tc.expect(t, "220 mx.example.com")
+	tc.send("EHLO client")
+	tc.expect(t, "250-mx.example.com", "250-", "250-", "250-", "250-", "250-", "250 ")
+	// quoted local-part containing '>'
+	tc.send("MAIL FROM:<\"a>b\"@example.com> BODY=8BITMIME\r\nRSET")
+	tc.expect(t, "250 2.1.0", "250 ")
+	// internationalized addresses require SMTPUTF8
+	tc.send("MAIL FROM:<用户@例子.广告>")
+	tc.expect(t, "553 5.6.7")
+	tc.send("MAIL FROM:<a@example.com>\r\nRCPT TO:<用户@例子.广告>\r\nRSET")
+	tc.expect(t, "250 2.1.0", "553 5.6.7", "250 ")
+	tc.send("MAIL FROM:<用户@例子.广告> SMTPUTF8\r\nRCPT TO:<b@例子.广告>")
+	tc.expect(t, "250 2.1.0", "250 2.1.5")
+}
+
+// textConn is a raw SMTP client connection
+type textConn struct {
+	c net.Conn
+	r *bufio.Reader
+}
+
+func newTextConn(c net.Conn) *textConn {
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	return &textConn{c: c, r: bufio.NewReader(c)}
+}
+
+func (tc *textConn) send(s string) {
+	tc.c.Write([]byte(s + "\r\n"))
+}
+
+// expect reads one reply line for each prefix, and checks it matches
+func (tc *textConn) expect(t *testing.T, prefixes ...string) {
+	t.Helper()
+	for _, p := range prefixes {
+		ln, err := tc.r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read reply: %s", err)
+		}
+		if !strings.HasPrefix(ln, p) {
+			t.Fatalf("expected reply %q, got %q", p, ln)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package pmail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// SMTPPhase is the step of the SMTP session during which an error occurred
+type SMTPPhase string
+
+const (
+	PhaseConnect SMTPPhase = "connect" // connection, greeting, EHLO and STARTTLS
+	PhaseAuth    SMTPPhase = "auth"
+	PhaseMail    SMTPPhase = "mail"
+	PhaseRcpt    SMTPPhase = "rcpt"
+	PhaseData    SMTPPhase = "data"
+)
+
+// SMTPError is an error that occurred while talking to a SMTP server
+type SMTPError struct {
+	Phase     SMTPPhase
+	Code      int    // SMTP reply code, 0 if the error did not come from the server
+	Enhanced  string // RFC 3463 enhanced status code such as "5.1.1", if provided by the server
+	Message   string // server reply text or error description
+	Recipient string // recipient concerned by the error, for the rcpt phase
+	Err       error  // underlying error
+}
+
+func (e *SMTPError) Error() string {
+	var b strings.Builder
+	b.WriteString("smtp ")
+	b.WriteString(string(e.Phase))
+	if e.Recipient != "" {
+		b.WriteString(" <" + e.Recipient + ">")
+	}
+	b.WriteString(": ")
+	if e.Code != 0 {
+		b.WriteString(strconv.Itoa(e.Code))
+		b.WriteByte(' ')
+	}
+	b.WriteString(e.Message)
+	return b.String()
+}
+
+func (e *SMTPError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary returns true if the error is a transient failure (4xx reply or network error) and
+// sending again later may succeed
+func (e *SMTPError) Temporary() bool {
+	if e.Code != 0 {
+		return e.Code >= 400 && e.Code < 500
+	}
+	return errors.Is(e.Err, ErrNotSent) || isNetworkError(e.Err)
+}
+
+// Permanent returns true if the server rejected the request with a 5xx reply, or if the error
+// did not come from the network, such as a server lacking an extension required by the
+// configuration or the message
+func (e *SMTPError) Permanent() bool {
+	if e.Code != 0 {
+		return e.Code >= 500 && e.Code < 600
+	}
+	return !e.Temporary()
+}
+
+// smtpErr converts err into a *SMTPError for the given phase
+func smtpErr(phase SMTPPhase, err error) *SMTPError {
+	var res *SMTPError
+	if errors.As(err, &res) {
+		return res
+	}
+	res = &SMTPError{Phase: phase, Message: err.Error(), Err: err}
+
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		res.Code = tpErr.Code
+		res.Message = tpErr.Msg
+		res.Enhanced = enhancedCode(tpErr.Code, tpErr.Msg)
+	}
+	return res
+}
+
+// isNetworkError returns true if err is caused by the connection, and not by the server replies
+// or the local configuration
+func isNetworkError(err error) bool {
+	var netErr net.Error
+	var protoErr textproto.ProtocolError
+	return errors.As(err, &netErr) ||
+		errors.As(err, &protoErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, context.Canceled)
+}
+
+// enhancedCode returns the RFC 3463 status code found at the start of msg, if its class
+// matches the reply code
+func enhancedCode(code int, msg string) string {
+	s, _, _ := strings.Cut(msg, " ")
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 || parts[0] != strconv.Itoa(code/100) {
+		return ""
+	}
+	for _, p := range parts[1:] {
+		if n, err := strconv.Atoi(p); err != nil || n < 0 || n > 999 {
+			return ""
+		}
+	}
+	return s
+}
+
+// SendResult holds the per-recipient outcome of a delivery
+type SendResult struct {
+	Accepted []string     // recipients accepted by the server
+	Rejected []*SMTPError // errors for recipients refused by the server
+}
+
+// Err returns an error for the rejected recipients, or nil if all were accepted. The error is
+// a *SMTPError if a single recipient was rejected, and a *RecipientsError otherwise.
+func (r *SendResult) Err() error {
+	switch len(r.Rejected) {
+	case 0:
+		return nil
+	case 1:
+		return r.Rejected[0]
+	}
+	return &RecipientsError{Rejected: r.Rejected}
+}
+
+// notSent moves the accepted recipients to the rejected ones with err, when the message could
+// not be transmitted to them
+func (r *SendResult) notSent(err *SMTPError) {
+	for _, addr := range r.Accepted {
+		e := *err
+		e.Recipient = addr
+		r.Rejected = append(r.Rejected, &e)
+	}
+	r.Accepted = nil
+}
+
+// RecipientsError is returned when several recipients were rejected
+type RecipientsError struct {
+	Rejected []*SMTPError
+}
+
+func (e *RecipientsError) Error() string {
+	msgs := make([]string, len(e.Rejected))
+	for n, r := range e.Rejected {
+		msgs[n] = r.Error()
+	}
+	return fmt.Sprintf("%d recipients rejected: %s", len(e.Rejected), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the errors of each recipient
+func (e *RecipientsError) Unwrap() []error {
+	res := make([]error, len(e.Rejected))
+	for n, r := range e.Rejected {
+		res[n] = r
+	}
+	return res
+}
+
+// Temporary returns true if sending again later may succeed for any of the recipients
+func (e *RecipientsError) Temporary() bool {
+	for _, r := range e.Rejected {
+		if r.Temporary() {
+			return true
+		}
+	}
+	return false
+}
+
+// Permanent returns true if all recipients were rejected permanently
+func (e *RecipientsError) Permanent() bool {
+	for _, r := range e.Rejected {
+		if !r.Permanent() {
+			return false
+		}
+	}
+	return true
+}
+
+// isPermanent returns true if err is a *SMTPError or *RecipientsError reporting a permanent
+// failure
+func isPermanent(err error) bool {
+	var pe interface{ Permanent() bool }
+	return errors.As(err, &pe) && pe.Permanent()
+}
+
+// ResultSender is implemented by senders able to report the outcome of a delivery for each
+// recipient. Deliver returns an error only if the message was not accepted for any recipient.
+type ResultSender interface {
+	Sender
+	Deliver(ctx context.Context, env *Envelope, msg io.WriterTo) (*SendResult, error)
+}